@@ -1,24 +1,171 @@
 package bot
 
 import (
+	"context"
 	"database/sql"
 	"github.com/mdesson/chatcord/discord"
 	"github.com/mdesson/chatcord/logger"
 	"github.com/mdesson/chatcord/openai"
 	"log/slog"
+	"sync"
+)
+
+// conversationKind is the kind of Discord channel a conversation is held in
+type conversationKind string
+
+const (
+	KIND_CHANNEL conversationKind = "channel" // A guild text channel
+	KIND_THREAD  conversationKind = "thread"  // A thread the bot started when it was mentioned
+	KIND_DM      conversationKind = "dm"      // A direct message channel with a single user
 )
 
 type conversation struct {
-	ChannelID string
+	ChannelID     string
+	GuildID       string // Empty for direct messages
+	Kind          conversationKind
+	Stream        bool           // Whether replies are streamed into the channel as they are generated
+	TopicPrompt   bool           // Whether the system prompt is kept in sync with the channel's topic
+	Policy        responsePolicy // Which messages the bot answers
+	Prefix        string         // Messages starting with it are answered under POLICY_PREFIX
+	RecordContext bool           // Whether messages the bot doesn't answer are kept in the history as context
+	ReplyIDs      []string       // Discord messages of the latest reply, the one which can be regenerated
+	ReplyIndex    int            // Index of the latest reply among the conversation's messages
+	mu            *sync.Mutex    // Guards the fields from Stream on, which commands change while handlers read them
 	*openai.Conversation
 }
 
+// streams reports whether replies are streamed into the channel
+func (c *conversation) streams() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Stream
+}
+
+func (c *conversation) setStream(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Stream = enabled
+}
+
+// followsTopic reports whether the system prompt is kept in sync with the channel's topic
+func (c *conversation) followsTopic() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.TopicPrompt
+}
+
+func (c *conversation) setTopicPrompt(enabled bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.TopicPrompt = enabled
+}
+
+// policy returns which messages the conversation answers, and what it does with the others
+func (c *conversation) policy() policySettings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return policySettings{Policy: c.Policy, Prefix: c.Prefix, RecordContext: c.RecordContext}
+}
+
+func (c *conversation) setPolicy(p policySettings) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Policy, c.Prefix, c.RecordContext = p.Policy, p.Prefix, p.RecordContext
+}
+
+// latestReply returns the index of the conversation's latest reply and its discord messages
+func (c *conversation) latestReply() (int, []string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ReplyIndex, c.ReplyIDs
+}
+
+// setLatestReply remembers ids as the discord messages of the reply at index, unless a later reply has been sent
+// already. It reports whether they were remembered.
+func (c *conversation) setLatestReply(index int, ids []string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if index < c.ReplyIndex {
+		return false
+	}
+	c.ReplyIndex, c.ReplyIDs = index, ids
+	return true
+}
+
+// conversationSet holds the conversations the bot is watching, keyed by channel ID. It is safe for concurrent use, as
+// discord handlers run concurrently.
+type conversationSet struct {
+	mu sync.RWMutex
+	m  map[string]*conversation
+}
+
+func newConversationSet() *conversationSet {
+	return &conversationSet{m: make(map[string]*conversation)}
+}
+
+func (cs *conversationSet) get(channelID string) (*conversation, bool) {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	c, ok := cs.m[channelID]
+	return c, ok
+}
+
+func (cs *conversationSet) set(c *conversation) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cs.m[c.ChannelID] = c
+}
+
+func (cs *conversationSet) remove(channelID string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	delete(cs.m, channelID)
+}
+
+func (cs *conversationSet) all() []*conversation {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	all := make([]*conversation, 0, len(cs.m))
+	for _, c := range cs.m {
+		all = append(all, c)
+	}
+	return all
+}
+
+// setGuild records which guild a conversation belongs to
+func (cs *conversationSet) setGuild(channelID string, guildID string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if c, ok := cs.m[channelID]; ok {
+		c.GuildID = guildID
+	}
+}
+
+// inGuild returns the conversations held in the guild's channels and threads
+func (cs *conversationSet) inGuild(guildID string) []*conversation {
+	cs.mu.RLock()
+	defer cs.mu.RUnlock()
+	var inGuild []*conversation
+	for _, c := range cs.m {
+		if c.GuildID == guildID {
+			inGuild = append(inGuild, c)
+		}
+	}
+	return inGuild
+}
+
 type Bot struct {
-	conversations map[string]*conversation
+	conversations *conversationSet
 	discordClient *discord.Client
-	openAIClient  *openai.Client
+	provider      openai.Provider
 	db            *sql.DB
 	l             *logger.Logger
+	ctx           context.Context // Cancelled on Stop to abort in-flight requests
+	cancel        context.CancelFunc
+	inFlight      *handlerTracker // Handlers that are still running, which may talk to OpenAI or the db
+	config        config
+	models        *modelCache
 }
 
 // New creates a new bot, which has access to a discord client and an OpenAI client
@@ -29,7 +176,12 @@ func New(logLevel slog.Level) (*Bot, error) {
 		return nil, err
 	}
 
-	openAIClient, err := openai.NewClient()
+	openAIClient, err := openai.NewClient(openai.ClientConfigFromEnv())
+	if err != nil {
+		return nil, err
+	}
+
+	cfg, err := loadConfig()
 	if err != nil {
 		return nil, err
 	}
@@ -40,7 +192,8 @@ func New(logLevel slog.Level) (*Bot, error) {
 	}
 
 	// init bot and add converations
-	b := &Bot{conversations: make(map[string]*conversation), discordClient: discordClient, openAIClient: openAIClient, db: db, l: logger.New(logLevel)}
+	ctx, cancel := context.WithCancel(context.Background())
+	b := &Bot{conversations: newConversationSet(), discordClient: discordClient, provider: openAIClient, db: db, l: logger.New(logLevel), ctx: ctx, cancel: cancel, inFlight: &handlerTracker{}, config: cfg, models: &modelCache{}}
 
 	conversations, err := selectAllConversations(*b)
 	if err != nil {
@@ -48,36 +201,63 @@ func New(logLevel slog.Level) (*Bot, error) {
 	}
 	for _, c := range conversations {
 		c := c
-		b.conversations[c.ChannelID] = &c
+		setupConversation(b, &c)
+		b.conversations.set(&c)
 	}
 
-	// prune converations for channels that no longer exist
-	channels, err := b.discordClient.Session.GuildChannels(b.discordClient.GuildID)
-	if err != nil {
-		return nil, err
-	}
+	return b, nil
+}
 
-	// Move entries form toDelete into toKeep as we discover them
-	toDelete := b.conversations
-	toKeep := make(map[string]*conversation)
+// setupConversation applies the bot's settings that aren't stored with a conversation
+func setupConversation(b *Bot, c *conversation) {
+	c.Init(conversationProvider(b, c))
+	c.mu = &sync.Mutex{}
+	c.Truncation = b.config.truncation
+	c.Summarization = b.config.summarization
+}
 
-	for _, channel := range channels {
-		if convo, ok := toDelete[channel.ID]; ok {
-			toKeep[channel.ID] = convo
-			delete(toDelete, channel.ID)
-		}
+// conversationProvider returns the provider a conversation sends its requests to. The OpenAI client is pointed at the
+// conversation's endpoint and lets the channel know when it retries.
+func conversationProvider(b *Bot, c *conversation) openai.Provider {
+	client, ok := b.provider.(*openai.Client)
+	if !ok {
+		return b.provider
 	}
+	return client.WithBaseURL(c.BaseURL).WithOnRetry(retryNotifier(b, c.ChannelID))
+}
 
-	// delete the remaining channels in toDelete & assign toKeep to bot
-	for channelID, _ := range toDelete {
-		if err := deleteConvoMessageUsage(*b, channelID); err != nil {
-			return nil, err
-		}
+// handlerTracker keeps count of the discord handlers that are running, so the bot can wait for them before closing the
+// db. Once stopped it refuses new handlers.
+type handlerTracker struct {
+	mu      sync.Mutex
+	stopped bool
+	running sync.WaitGroup
+}
+
+// start registers a handler about to run, and reports false if the bot is stopping and it shouldn't
+func (t *handlerTracker) start() bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.stopped {
+		return false
 	}
+	t.running.Add(1)
+	return true
+}
 
-	b.conversations = toKeep
+// done marks a handler registered with start as finished
+func (t *handlerTracker) done() {
+	t.running.Done()
+}
 
-	return b, nil
+// stop refuses new handlers, then waits for the running ones to finish
+func (t *handlerTracker) stop() {
+	t.mu.Lock()
+	t.stopped = true
+	t.mu.Unlock()
+
+	t.running.Wait()
 }
 
 // Start registers discord handlers and then starts the discord session
@@ -90,16 +270,28 @@ func (b *Bot) Start() error {
 	// Handler to respond to messages in conversations
 	b.discordClient.Session.AddHandler(MakeMessageCreateHandler(b))
 
+	// Handler keeping system prompts in sync with channel topics
+	b.discordClient.Session.AddHandler(MakeChannelUpdateHandler(b))
+
 	// Handler clear out db on channel delete
 	b.discordClient.Session.AddHandler(MakeChannelDeleteHandler(b))
 
-	// Open the session, it is now listening for events
-	if err := b.discordClient.Session.Open(); err != nil {
-		return err
-	}
+	// Handlers ending thread conversations once their thread is archived or deleted
+	b.discordClient.Session.AddHandler(MakeThreadUpdateHandler(b))
+	b.discordClient.Session.AddHandler(MakeThreadDeleteHandler(b))
+
+	// Handler running slash commands
+	b.discordClient.Session.AddHandler(MakeInteractionCreateHandler(b))
 
-	// TODO: Swap to user-friendly init message
-	if err := b.discordClient.SendMessage("online", b.discordClient.GeneralChannel); err != nil {
+	// Handler regenerating replies when they are reacted to with 🔁
+	b.discordClient.Session.AddHandler(MakeMessageReactionAddHandler(b))
+
+	// Handlers setting up the guilds the bot is in, or joins, and cleaning up after the ones it leaves
+	b.discordClient.Session.AddHandler(MakeGuildCreateHandler(b))
+	b.discordClient.Session.AddHandler(MakeGuildDeleteHandler(b))
+
+	// Open the session, it is now listening for events. Guilds are set up as discord sends them.
+	if err := b.discordClient.Session.Open(); err != nil {
 		return err
 	}
 
@@ -111,14 +303,18 @@ func (b *Bot) Start() error {
 func (b *Bot) Stop() {
 	b.l.Info("stopping")
 
-	if err := b.discordClient.SendMessage("going offline", b.discordClient.GeneralChannel); err != nil {
-		b.l.Error(err.Error())
+	for _, guild := range b.discordClient.Session.State.Guilds {
+		announce(b, guild.ID, "going offline")
 	}
 
-	if err := b.db.Close(); err != nil {
+	// Abort requests to OpenAI, stop receiving events, and let the handlers finish up before closing the db
+	b.cancel()
+	if err := b.discordClient.Session.Close(); err != nil {
 		b.l.Error(err.Error())
 	}
-	if err := b.discordClient.Session.Close(); err != nil {
+	b.inFlight.stop()
+
+	if err := b.db.Close(); err != nil {
 		b.l.Error(err.Error())
 	}
 
@@ -0,0 +1,388 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/mdesson/chatcord/openai"
+	"strings"
+)
+
+// isTextChannel reports whether the bot can hold a conversation in the channel
+func isTextChannel(channel *discordgo.Channel) bool {
+	return channel.Type == discordgo.ChannelTypeGuildText
+}
+
+// isEligible reports whether a channel should automatically become a conversation: it must be a text channel, and
+// either sit under one of the configured categories or have a name starting with the configured prefix. The channel's
+// category is looked up in guildChannels if given, otherwise it is fetched.
+func isEligible(b *Bot, channel *discordgo.Channel, guildChannels []*discordgo.Channel) bool {
+	if !isTextChannel(channel) {
+		return false
+	}
+
+	if b.config.channelPrefix != "" && strings.HasPrefix(channel.Name, b.config.channelPrefix) {
+		return true
+	}
+
+	if channel.ParentID == "" || len(b.config.channelCategories) == 0 {
+		return false
+	}
+
+	// Categories can be configured by ID or by name
+	categoryName := lookupChannelName(b, channel.ParentID, guildChannels)
+	for _, c := range b.config.channelCategories {
+		if c == channel.ParentID || (categoryName != "" && strings.EqualFold(c, categoryName)) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// lookupChannelName returns the name of a channel, looking it up in guildChannels if given and fetching it otherwise.
+// It returns an empty string if the channel can't be found.
+func lookupChannelName(b *Bot, channelID string, guildChannels []*discordgo.Channel) string {
+	if guildChannels != nil {
+		for _, c := range guildChannels {
+			if c.ID == channelID {
+				return c.Name
+			}
+		}
+		return ""
+	}
+
+	if channel, err := fetchChannel(b, channelID); err == nil {
+		return channel.Name
+	}
+	return ""
+}
+
+// fetchChannel returns a channel from the session's state, falling back to asking discord for it
+func fetchChannel(b *Bot, channelID string) (*discordgo.Channel, error) {
+	if channel, err := b.discordClient.Session.State.Channel(channelID); err == nil {
+		return channel, nil
+	}
+	return b.discordClient.Session.Channel(channelID)
+}
+
+// reconcile brings a guild's conversations in line with its channels, for when channels were created or deleted
+// while the bot was offline: conversations whose channel or thread is gone or archived are deleted, and eligible
+// channels that aren't conversations yet are adopted.
+func reconcile(b *Bot, guildID string) error {
+	channels, err := b.discordClient.Session.GuildChannels(guildID)
+	if err != nil {
+		return err
+	}
+
+	// Threads aren't listed with the guild's channels, and only the active ones are worth keeping
+	threads, err := b.discordClient.Session.GuildThreadsActive(guildID)
+	if err != nil {
+		return err
+	}
+
+	existing := make(map[string]bool)
+	for _, channel := range channels {
+		existing[channel.ID] = true
+	}
+	for _, thread := range threads.Threads {
+		existing[thread.ID] = true
+	}
+
+	// Conversations started before the bot served several guilds don't know which one they belong to
+	for _, c := range b.conversations.inGuild("") {
+		if c.Kind != KIND_DM && existing[c.ChannelID] {
+			if err := updateConversationGuild(*b, c.ChannelID, guildID); err != nil {
+				return err
+			}
+			b.conversations.setGuild(c.ChannelID, guildID)
+		}
+	}
+
+	var pruned, adopted []string
+	for _, c := range b.conversations.inGuild(guildID) {
+		if !existing[c.ChannelID] {
+			pruned = append(pruned, c.ChannelID)
+		}
+	}
+
+	var toAdopt []*discordgo.Channel
+	for _, channel := range channels {
+		if _, ok := b.conversations.get(channel.ID); !ok && isEligible(b, channel, channels) {
+			toAdopt = append(toAdopt, channel)
+			adopted = append(adopted, channel.ID)
+		}
+	}
+
+	b.l.Info("reconciling channels", "guild_id", guildID, "pruned", pruned, "adopted", adopted)
+
+	for _, channelID := range pruned {
+		if err := endConversation(b, channelID); err != nil {
+			return err
+		}
+	}
+
+	for _, channel := range toAdopt {
+		if _, err := startConversation(b, channel); errors.Is(err, errConversationLimit) {
+			b.l.Warn(err.Error(), "guild_id", guildID, "channel_id", channel.ID)
+			break
+		} else if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkConversationLimit returns errConversationLimit if the guild can't hold another conversation
+func checkConversationLimit(b *Bot, g guildSettings) error {
+	if g.MaxConversations > 0 && len(b.conversations.inGuild(g.GuildID)) >= g.MaxConversations {
+		return errConversationLimit
+	}
+	return nil
+}
+
+// startConversation creates a new conversation for a channel, storing it in the db and adding it to the bot
+func startConversation(b *Bot, channel *discordgo.Channel) (*conversation, error) {
+	// Direct messages have their own defaults
+	model, prompt := b.config.dmModel, b.config.dmSystemPrompt
+	if channel.Type != discordgo.ChannelTypeDM {
+		g := loadGuildSettings(b, channel.GuildID)
+		if err := checkConversationLimit(b, g); err != nil {
+			return nil, err
+		}
+
+		model, prompt = b.config.defaultModel, guildDefaultPrompt(b, channel.GuildID)
+		if g.DefaultModel != "" {
+			model = g.DefaultModel
+		}
+		if b.config.topicPrompts {
+			if topic := topicPrompt(channel.Topic); topic != "" {
+				prompt = topic
+			}
+		}
+	}
+
+	c := conversation{
+		ChannelID:     channel.ID,
+		GuildID:       channel.GuildID,
+		Kind:          KIND_CHANNEL,
+		Stream:        b.config.streamReplies,
+		TopicPrompt:   b.config.topicPrompts,
+		Policy:        b.config.responsePolicy,
+		Prefix:        b.config.responsePrefix,
+		RecordContext: b.config.recordContext,
+		Conversation:  openai.NewConversation(model, prompt, b.provider),
+	}
+	// Threads have no topic to follow, and were started to talk to the bot
+	if channel.IsThread() {
+		c.Kind = KIND_THREAD
+		c.TopicPrompt = false
+		c.Policy = POLICY_ALWAYS
+	}
+	// Every direct message is for the bot
+	if channel.Type == discordgo.ChannelTypeDM {
+		c.Kind = KIND_DM
+		c.TopicPrompt = false
+		c.Policy = POLICY_ALWAYS
+	}
+
+	setupConversation(b, &c)
+
+	if err := createConvoMessageUsage(*b, c); err != nil {
+		return nil, err
+	}
+
+	b.conversations.set(&c)
+	b.l.Info("started conversation", "channel_id", channel.ID, "channel_name", channel.Name)
+	return &c, nil
+}
+
+// endConversation deletes a conversation from the db and stops the bot from watching it
+func endConversation(b *Bot, channelID string) error {
+	if err := deleteConvoMessageUsage(*b, channelID); err != nil {
+		return err
+	}
+	b.conversations.remove(channelID)
+	b.l.Info("ended conversation", "channel_id", channelID)
+	return nil
+}
+
+// threadArchiveMinutes is how long a conversation's thread can go quiet before Discord archives it, which ends the
+// conversation
+const threadArchiveMinutes = 1440
+
+// mentionsUser reports whether the message mentions the user
+func mentionsUser(message *discordgo.Message, userID string) bool {
+	for _, user := range message.Mentions {
+		if user.ID == userID {
+			return true
+		}
+	}
+	return false
+}
+
+// stripMention removes the user's mentions from content, as in "<@id>" or "<@!id>", such as the one used to call the
+// bot. Other members mentioned are left in.
+func stripMention(content string, userID string) string {
+	return strings.TrimSpace(strings.NewReplacer("<@"+userID+">", "", "<@!"+userID+">", "").Replace(content))
+}
+
+// startThread starts a thread on message and makes it a new conversation
+func startThread(b *Bot, message *discordgo.Message, content string) (*conversation, error) {
+	// Don't leave an empty thread behind when the guild can't hold another conversation
+	if err := checkConversationLimit(b, loadGuildSettings(b, message.GuildID)); err != nil {
+		return nil, err
+	}
+
+	thread, err := b.discordClient.Session.MessageThreadStartComplex(message.ChannelID, message.ID, &discordgo.ThreadStart{
+		Name:                threadName(message, content),
+		AutoArchiveDuration: threadArchiveMinutes,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return startConversation(b, thread)
+}
+
+// threadName names a conversation's thread after the first line of the message which started it
+func threadName(message *discordgo.Message, content string) string {
+	name, _, _ := strings.Cut(content, "\n")
+	name = strings.TrimSpace(name)
+	if name == "" {
+		return fmt.Sprintf("Chat with %s", message.Author.Username)
+	}
+
+	// Discord allows up to 100 characters, keep it to something that fits in the channel list
+	if runes := []rune(name); len(runes) > 50 {
+		name = strings.TrimSpace(string(runes[:50])) + "…"
+	}
+	return name
+}
+
+// chatCommand turns conversations on or off in a channel
+func chatCommand() command {
+	return command{
+		definition: &discordgo.ApplicationCommand{
+			Name:                     "chat",
+			Description:              "Turn the bot on or off in this channel",
+			DefaultMemberPermissions: &manageChannels,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "enable",
+					Description: "Make this channel a conversation with the bot",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "disable",
+					Description: "Stop the conversation in this channel and forget its history",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "policy",
+					Description: "Show or change which messages the bot answers in this channel",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "mode",
+							Description: "Which messages to answer",
+							Choices:     policyChoices,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "prefix",
+							Description: "Messages starting with it are answered in prefix mode",
+							MaxLength:   32,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "record",
+							Description: "Remember the messages the bot doesn't answer as context",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "stream",
+					Description: "Show or change whether replies in this channel are streamed as they are generated",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "enabled",
+							Description: "Stream replies into the channel as they are generated",
+						},
+					},
+				},
+			},
+		},
+		handler: func(b *Bot, i *discordgo.InteractionCreate, opts commandOptions) error {
+			switch opts.subcommand {
+			case "enable":
+				if _, ok := b.conversations.get(i.ChannelID); ok {
+					return userError("This channel is already a conversation.")
+				}
+
+				channel, err := b.discordClient.Session.Channel(i.ChannelID)
+				if err != nil {
+					return err
+				}
+				if !isTextChannel(channel) {
+					return userError("Conversations can only be held in text channels.")
+				}
+
+				if _, err := startConversation(b, channel); errors.Is(err, errConversationLimit) {
+					return userError(conversationLimitMessage)
+				} else if err != nil {
+					return err
+				}
+				respond(b, i, "👋 I'll answer messages in this channel from now on.")
+				return nil
+			case "disable":
+				if _, ok := b.conversations.get(i.ChannelID); !ok {
+					return userError("This channel isn't a conversation.")
+				}
+
+				if err := endConversation(b, i.ChannelID); err != nil {
+					return err
+				}
+
+				respond(b, i, "I'll stop answering messages in this channel.")
+				return nil
+			case "policy":
+				c, ok := b.conversations.get(i.ChannelID)
+				if !ok {
+					return userError("This channel isn't a conversation.")
+				}
+				return policySubcommand(b, i, c, opts)
+			case "stream":
+				c, ok := b.conversations.get(i.ChannelID)
+				if !ok {
+					return userError("This channel isn't a conversation.")
+				}
+
+				enabled, ok := opts.Bool("enabled")
+				if !ok {
+					respondEphemeral(b, i, formatStream(c.streams()))
+					return nil
+				}
+				if err := updateStream(*b, c.ChannelID, enabled); err != nil {
+					return err
+				}
+				c.setStream(enabled)
+				respond(b, i, formatStream(enabled))
+				return nil
+			default:
+				return fmt.Errorf("unknown subcommand %q", opts.subcommand)
+			}
+		},
+	}
+}
+
+func formatStream(enabled bool) string {
+	if enabled {
+		return "Replies in this channel are streamed as they are generated."
+	}
+	return "Replies in this channel are sent once they are complete."
+}
@@ -0,0 +1,324 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"strings"
+)
+
+// command is a slash command. Add new commands to the list returned by commands to have them registered.
+type command struct {
+	// Definition registered with Discord. Its DefaultMemberPermissions are also checked when the command is run.
+	definition *discordgo.ApplicationCommand
+	// handler runs the command. Errors made with userError are shown to the member, any other error is logged.
+	handler func(b *Bot, i *discordgo.InteractionCreate, opts commandOptions) error
+	// autocomplete suggests values for the option being typed, named by focused. Only needed if an option autocompletes.
+	autocomplete func(b *Bot, i *discordgo.InteractionCreate, focused string, opts commandOptions) []*discordgo.ApplicationCommandOptionChoice
+	// modal handles the submission of a modal the command opened with openModal. Only needed if the command opens one.
+	modal func(b *Bot, i *discordgo.InteractionCreate, data discordgo.ModalSubmitInteractionData) error
+	// component handles a click on a button the command attached to a message, whose custom ID is the command's name
+	// optionally followed by ":" and anything the command needs to remember. Only needed if the command adds buttons.
+	component func(b *Bot, i *discordgo.InteractionCreate, data discordgo.MessageComponentInteractionData) error
+}
+
+// commands returns every slash command the bot serves
+func commands() []command {
+	return []command{
+		usageCommand(),
+		chatCommand(),
+		modelCommand(),
+		temperatureCommand(),
+		choicesCommand(),
+		systemCommand(),
+		presetCommand(),
+		serverCommand(),
+		transcriptCommand(),
+		regenerateCommand(),
+	}
+}
+
+// commandOptions are the options a command was invoked with, keyed by name. Options of a subcommand are flattened in.
+type commandOptions struct {
+	subcommand string // Name of the invoked subcommand, prefixed by its group as "group subcommand"
+	options    map[string]*discordgo.ApplicationCommandInteractionDataOption
+}
+
+func parseOptions(options []*discordgo.ApplicationCommandInteractionDataOption) commandOptions {
+	opts := commandOptions{options: make(map[string]*discordgo.ApplicationCommandInteractionDataOption)}
+	for len(options) > 0 {
+		nested := options
+		options = nil
+		for _, opt := range nested {
+			switch opt.Type {
+			case discordgo.ApplicationCommandOptionSubCommandGroup, discordgo.ApplicationCommandOptionSubCommand:
+				if opts.subcommand != "" {
+					opts.subcommand += " "
+				}
+				opts.subcommand += opt.Name
+				options = opt.Options
+			default:
+				opts.options[opt.Name] = opt
+			}
+		}
+	}
+	return opts
+}
+
+func (o commandOptions) String(name string) (string, bool) {
+	if opt, ok := o.options[name]; ok {
+		return opt.StringValue(), true
+	}
+	return "", false
+}
+
+func (o commandOptions) Int(name string) (int64, bool) {
+	if opt, ok := o.options[name]; ok {
+		return opt.IntValue(), true
+	}
+	return 0, false
+}
+
+func (o commandOptions) Float(name string) (float64, bool) {
+	if opt, ok := o.options[name]; ok {
+		return opt.FloatValue(), true
+	}
+	return 0, false
+}
+
+func (o commandOptions) Bool(name string) (bool, bool) {
+	if opt, ok := o.options[name]; ok {
+		return opt.BoolValue(), true
+	}
+	return false, false
+}
+
+// commandError is an error whose message is meant for the member who ran the command
+type commandError struct {
+	msg string
+}
+
+func (e *commandError) Error() string {
+	return e.msg
+}
+
+// userError creates an error to show to the member who ran the command, such as a validation failure
+func userError(format string, a ...any) error {
+	return &commandError{msg: fmt.Sprintf(format, a...)}
+}
+
+// syncCommands registers the bot's commands in a guild, replacing whatever was registered before
+func syncCommands(b *Bot, guildID string) error {
+	cmds := commands()
+	definitions := make([]*discordgo.ApplicationCommand, 0, len(cmds))
+	for _, cmd := range cmds {
+		definitions = append(definitions, cmd.definition)
+	}
+
+	_, err := b.discordClient.Session.ApplicationCommandBulkOverwrite(b.discordClient.Session.State.User.ID, guildID, definitions)
+	return err
+}
+
+func MakeInteractionCreateHandler(b *Bot) func(s *discordgo.Session, event *discordgo.InteractionCreate) {
+	cmds := make(map[string]command)
+	for _, cmd := range commands() {
+		cmds[cmd.definition.Name] = cmd
+	}
+
+	return func(s *discordgo.Session, event *discordgo.InteractionCreate) {
+		if !b.inFlight.start() {
+			return
+		}
+		defer b.inFlight.done()
+
+		var name string
+		switch event.Type {
+		case discordgo.InteractionApplicationCommand, discordgo.InteractionApplicationCommandAutocomplete:
+			name = event.ApplicationCommandData().Name
+		case discordgo.InteractionModalSubmit:
+			// Modals are opened by commands, with a custom ID of "<command>" or "<command>:<anything>"
+			name, _, _ = strings.Cut(event.ModalSubmitData().CustomID, ":")
+		case discordgo.InteractionMessageComponent:
+			// As are buttons
+			name, _, _ = strings.Cut(event.MessageComponentData().CustomID, ":")
+		default:
+			return
+		}
+		b.l.Debug("called", "channel_id", event.ChannelID, "handler", "interaction_create", "command", name)
+
+		cmd, ok := cmds[name]
+		if !ok {
+			b.l.Warn("unknown command", "handler", "interaction_create", "command", name)
+			return
+		}
+
+		if event.Type == discordgo.InteractionApplicationCommandAutocomplete {
+			autocomplete(b, event, cmd, event.ApplicationCommandData())
+			return
+		}
+
+		// Discord hides commands from members without the default permissions, but server admins can override that
+		if !hasPermissions(event, cmd.definition.DefaultMemberPermissions) {
+			respondEphemeral(b, event, "You don't have permission to use this command.")
+			return
+		}
+
+		var err error
+		switch event.Type {
+		case discordgo.InteractionModalSubmit:
+			if cmd.modal == nil {
+				b.l.Warn("command has no modal", "handler", "interaction_create", "command", name)
+				return
+			}
+			err = cmd.modal(b, event, event.ModalSubmitData())
+		case discordgo.InteractionMessageComponent:
+			if cmd.component == nil {
+				b.l.Warn("command has no components", "handler", "interaction_create", "command", name)
+				return
+			}
+			err = cmd.component(b, event, event.MessageComponentData())
+		default:
+			err = cmd.handler(b, event, parseOptions(event.ApplicationCommandData().Options))
+		}
+
+		if err != nil {
+			var cmdErr *commandError
+			if errors.As(err, &cmdErr) {
+				respondEphemeral(b, event, cmdErr.msg)
+				return
+			}
+			b.l.Error(err.Error(), "handler", "interaction_create", "command", name, "channel_id", event.ChannelID)
+			respondEphemeral(b, event, "Something went wrong running that command.")
+		}
+	}
+}
+
+// autocomplete responds with the command's suggestions for the option the member is typing
+func autocomplete(b *Bot, i *discordgo.InteractionCreate, cmd command, data discordgo.ApplicationCommandInteractionData) {
+	var choices []*discordgo.ApplicationCommandOptionChoice
+
+	opts := parseOptions(data.Options)
+	if cmd.autocomplete != nil {
+		for name, opt := range opts.options {
+			if opt.Focused {
+				choices = cmd.autocomplete(b, i, name, opts)
+				break
+			}
+		}
+	}
+
+	// Discord shows at most 25 suggestions
+	if len(choices) > 25 {
+		choices = choices[:25]
+	}
+
+	err := b.discordClient.Session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionApplicationCommandAutocompleteResult,
+		Data: &discordgo.InteractionResponseData{Choices: choices},
+	})
+	if err != nil {
+		b.l.Error(err.Error(), "channel_id", i.ChannelID, "command", data.Name)
+	}
+}
+
+// hasPermissions reports whether the member who created the interaction has all of the permissions
+func hasPermissions(i *discordgo.InteractionCreate, permissions *int64) bool {
+	if permissions == nil || *permissions == 0 {
+		return true
+	}
+	if i.Member == nil {
+		return false
+	}
+	if i.Member.Permissions&discordgo.PermissionAdministrator != 0 {
+		return true
+	}
+	return i.Member.Permissions&*permissions == *permissions
+}
+
+// respond replies to an interaction with a message visible to the whole channel
+func respond(b *Bot, i *discordgo.InteractionCreate, content string) {
+	sendResponse(b, i, &discordgo.InteractionResponseData{Content: content})
+}
+
+// respondEphemeral replies to an interaction with a message only the member who created it can see
+func respondEphemeral(b *Bot, i *discordgo.InteractionCreate, content string) {
+	sendResponse(b, i, &discordgo.InteractionResponseData{Content: content, Flags: discordgo.MessageFlagsEphemeral})
+}
+
+// openModal responds to an interaction with a modal asking for a single paragraph of text. customID must be the
+// command's name, optionally followed by ":" and anything the command needs to remember.
+func openModal(b *Bot, i *discordgo.InteractionCreate, customID string, title string, label string, value string) error {
+	return b.discordClient.Session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseModal,
+		Data: &discordgo.InteractionResponseData{
+			CustomID: customID,
+			Title:    title,
+			Components: []discordgo.MessageComponent{
+				discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+					discordgo.TextInput{
+						CustomID:  "text",
+						Label:     label,
+						Style:     discordgo.TextInputParagraph,
+						Value:     value,
+						Required:  true,
+						MaxLength: 4000,
+					},
+				}},
+			},
+		},
+	})
+}
+
+// modalText returns the text entered in a modal opened with openModal
+func modalText(data discordgo.ModalSubmitInteractionData) string {
+	for _, row := range data.Components {
+		actionsRow, ok := row.(*discordgo.ActionsRow)
+		if !ok {
+			continue
+		}
+		for _, component := range actionsRow.Components {
+			if input, ok := component.(*discordgo.TextInput); ok && input.CustomID == "text" {
+				return input.Value
+			}
+		}
+	}
+	return ""
+}
+
+func sendResponse(b *Bot, i *discordgo.InteractionCreate, data *discordgo.InteractionResponseData) {
+	err := b.discordClient.Session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: data,
+	})
+	if err != nil {
+		b.l.Error(err.Error(), "channel_id", i.ChannelID)
+	}
+}
+
+// usageCommand shows how many tokens a conversation is using
+func usageCommand() command {
+	return command{
+		definition: &discordgo.ApplicationCommand{
+			Name:        "usage",
+			Description: "Show how many tokens this channel's conversation is using",
+		},
+		handler: func(b *Bot, i *discordgo.InteractionCreate, opts commandOptions) error {
+			c, ok := b.conversations.get(i.ChannelID)
+			if !ok {
+				return userError("This channel isn't a conversation.")
+			}
+
+			tokens, err := c.PromptTokens("")
+			if err != nil {
+				return err
+			}
+
+			usage := c.LastUsage()
+			respondEphemeral(b, i, fmt.Sprintf(
+				"The next message will send about **%d** tokens of history to `%s`.\nThe last reply used %d prompt and %d completion tokens.",
+				tokens, c.Settings().Model, usage.PromptTokens, usage.CompletionTokens,
+			))
+			return nil
+		},
+	}
+}
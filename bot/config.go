@@ -0,0 +1,69 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/mdesson/chatcord/openai"
+	"github.com/mdesson/chatcord/util"
+)
+
+// config holds the bot's settings, read from the environment
+type config struct {
+	channelCategories []string             // IDs or names of the categories whose new text channels become conversations
+	channelPrefix     string               // New text channels whose name starts with it become conversations
+	defaultModel      openai.Model         // Model new conversations start with
+	streamReplies     bool                 // Default for whether new conversations stream their replies
+	topicPrompts      bool                 // Default for whether new conversations take their system prompt from the channel topic
+	threadMode        bool                 // Whether mentioning the bot outside of a conversation starts one in a new thread
+	responsePolicy    responsePolicy       // Default for which messages new channel conversations answer
+	responsePrefix    string               // Default prefix for conversations answering prefixed messages
+	recordContext     bool                 // Default for whether new conversations remember messages they don't answer
+	dmEnabled         bool                 // Whether members can talk to the bot in direct messages
+	dmModel           openai.Model         // Model new direct message conversations start with
+	dmSystemPrompt    string               // System prompt new direct message conversations start with
+	dmDailyLimit      int                  // Messages each user can send the bot in direct messages per day, 0 for no limit
+	truncation        openai.Truncation    // How long conversations are cut down to fit the model
+	summarization     openai.Summarization // When older turns are folded into a running summary
+}
+
+func loadConfig() (config, error) {
+	defaultModel := openai.Model(util.EnvString("DEFAULT_MODEL", string(openai.GPT_4_TURBO)))
+	c := config{
+		channelCategories: util.EnvList("CHANNEL_CATEGORIES"),
+		channelPrefix:     util.EnvString("CHANNEL_PREFIX", ""),
+		defaultModel:      defaultModel,
+		streamReplies:     util.EnvBool("STREAM_REPLIES", false),
+		topicPrompts:      util.EnvBool("TOPIC_PROMPTS", false),
+		threadMode:        util.EnvBool("THREAD_MODE", false),
+		responsePolicy:    responsePolicy(util.EnvString("RESPONSE_POLICY", string(POLICY_ALWAYS))),
+		responsePrefix:    util.EnvString("RESPONSE_PREFIX", "!ask"),
+		recordContext:     util.EnvBool("RECORD_CONTEXT", false),
+		dmEnabled:         util.EnvBool("DM_ENABLED", false),
+		dmModel:           openai.Model(util.EnvString("DM_MODEL", string(defaultModel))),
+		dmSystemPrompt:    util.EnvString("DM_SYSTEM_PROMPT", defaultSystemPrompt),
+		dmDailyLimit:      util.EnvInt("DM_DAILY_LIMIT", 0),
+		truncation: openai.Truncation{
+			Strategy:      openai.TruncationStrategy(util.EnvString("CONTEXT_STRATEGY", string(openai.TRUNCATE_TOKEN_BUDGET))),
+			MaxMessages:   util.EnvInt("CONTEXT_MAX_MESSAGES", 50),
+			MaxTokens:     util.EnvInt("CONTEXT_MAX_TOKENS", 0),
+			ReserveTokens: util.EnvInt("CONTEXT_RESERVE_TOKENS", 4096),
+		},
+		summarization: openai.Summarization{
+			Threshold:  util.EnvInt("SUMMARY_THRESHOLD", 0),
+			KeepRecent: util.EnvInt("SUMMARY_KEEP_RECENT", 10),
+		},
+	}
+
+	if !c.truncation.Strategy.Valid() {
+		return config{}, fmt.Errorf("CONTEXT_STRATEGY must be one of none, sliding_window, drop_oldest_pairs or token_budget, got %q", c.truncation.Strategy)
+	}
+	if c.summarization.KeepRecent < 0 {
+		return config{}, fmt.Errorf("SUMMARY_KEEP_RECENT can't be negative, got %d", c.summarization.KeepRecent)
+	}
+	if !c.responsePolicy.valid() {
+		return config{}, fmt.Errorf("RESPONSE_POLICY must be one of always, mention, reply or prefix, got %q", c.responsePolicy)
+	}
+	if c.responsePolicy == POLICY_PREFIX && c.responsePrefix == "" {
+		return config{}, fmt.Errorf("RESPONSE_PREFIX must be set when RESPONSE_POLICY is prefix")
+	}
+	return c, nil
+}
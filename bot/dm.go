@@ -0,0 +1,54 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"time"
+)
+
+// startDM makes the direct message channel the message was sent in a new conversation
+func startDM(b *Bot, message *discordgo.Message) (*conversation, error) {
+	channel, err := fetchChannel(b, message.ChannelID)
+	if err != nil {
+		return nil, err
+	}
+	return startConversation(b, channel)
+}
+
+// quotaDay is the day a direct message counts towards, days start at midnight UTC
+func quotaDay(t time.Time) string {
+	return t.UTC().Format(time.DateOnly)
+}
+
+// dmQuotaReached reports whether the user has used up their direct messages for the day, letting them know if so
+func dmQuotaReached(b *Bot, userID string, channelID string) bool {
+	if b.config.dmDailyLimit <= 0 {
+		return false
+	}
+
+	count, err := selectDMCount(*b, userID, quotaDay(time.Now()))
+	if err != nil {
+		// Don't hold up the conversation because the quota couldn't be checked
+		b.l.Error(err.Error(), "handler", "message_create", "channel_id", channelID, "user_id", userID)
+		return false
+	}
+	if count < b.config.dmDailyLimit {
+		return false
+	}
+
+	msg := fmt.Sprintf("You've reached the limit of %d direct messages for today, try again tomorrow.", b.config.dmDailyLimit)
+	if err := b.discordClient.SendMessage(msg, channelID); err != nil {
+		b.l.Error(err.Error(), "handler", "message_create", "channel_id", channelID)
+	}
+	return true
+}
+
+// countDM counts an answered direct message towards the user's quota
+func countDM(b *Bot, userID string) {
+	if b.config.dmDailyLimit <= 0 {
+		return
+	}
+	if err := incrementDMCount(*b, userID, quotaDay(time.Now())); err != nil {
+		b.l.Error(err.Error(), "handler", "message_create", "user_id", userID)
+	}
+}
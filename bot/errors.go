@@ -0,0 +1,34 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"github.com/mdesson/chatcord/openai"
+)
+
+// userErrorMessage turns an error from the OpenAI client into a message fit to show in the channel
+func userErrorMessage(err error) string {
+	var (
+		rateLimitErr     *openai.RateLimitError
+		authErr          *openai.AuthError
+		contextLengthErr *openai.ContextLengthError
+		serverErr        *openai.ServerError
+	)
+
+	switch {
+	case errors.As(err, &rateLimitErr):
+		return "⚠️ I'm being rate limited by OpenAI right now, please try again in a little while."
+	case errors.As(err, &authErr):
+		return "⚠️ I couldn't authenticate with OpenAI. Ask an admin to check the API token."
+	case errors.As(err, &contextLengthErr):
+		return "⚠️ This conversation has grown too long for the model. Start a new channel to keep chatting."
+	case errors.Is(err, openai.ErrNoReply):
+		return "⚠️ Only the latest reply can be regenerated, and only until someone says something after it or it gets summarized."
+	case errors.Is(err, context.DeadlineExceeded):
+		return "⚠️ OpenAI took too long to respond, please try again."
+	case errors.As(err, &serverErr):
+		return "⚠️ OpenAI is having trouble at the moment, please try again shortly."
+	default:
+		return "⚠️ Something went wrong while getting a response, please try again."
+	}
+}
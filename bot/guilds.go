@@ -0,0 +1,323 @@
+package bot
+
+import (
+	"errors"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/mdesson/chatcord/openai"
+	"strings"
+	"sync"
+)
+
+// guildSettings are a guild's own settings, which take precedence over the bot's configuration
+type guildSettings struct {
+	GuildID          string
+	DefaultPreset    string       // Preset new channels start with, empty for the default system prompt
+	GeneralChannel   string       // Channel the bot announces itself in, empty to fall back to GENERAL_CHANNEL_ID
+	DefaultModel     openai.Model // Model new conversations start with, empty to fall back to DEFAULT_MODEL
+	MaxConversations int          // Conversations the guild can hold at once, 0 for no limit
+}
+
+// errConversationLimit is returned when starting a conversation would take a guild over its limit
+var errConversationLimit = errors.New("guild has reached its conversation limit")
+
+// conversationLimitMessage tells members why no new conversation was started
+const conversationLimitMessage = "This server can't hold any more conversations, end one with `/chat disable` first."
+
+// loadGuildSettings returns the guild's settings, or the defaults if they can't be read
+func loadGuildSettings(b *Bot, guildID string) guildSettings {
+	g, err := selectGuild(*b, guildID)
+	if err != nil {
+		b.l.Error(err.Error(), "guild_id", guildID)
+		return guildSettings{GuildID: guildID}
+	}
+	return g
+}
+
+// generalChannel returns the channel the bot announces itself in within the guild, or an empty string if it has none.
+// A channel picked with /server comes first, then the configured ID and name, then the guild's system channel.
+func generalChannel(b *Bot, guildID string) string {
+	if g := loadGuildSettings(b, guildID); g.GeneralChannel != "" {
+		return g.GeneralChannel
+	}
+
+	client := b.discordClient
+	// GENERAL_CHANNEL_ID belongs to a single guild
+	if client.GeneralChannel != "" {
+		if channel, err := fetchChannel(b, client.GeneralChannel); err == nil && channel.GuildID == guildID {
+			return channel.ID
+		}
+	}
+
+	if client.GeneralChannelName != "" {
+		channels, err := guildChannels(b, guildID)
+		if err != nil {
+			b.l.Error(err.Error(), "guild_id", guildID)
+		}
+		for _, channel := range channels {
+			if isTextChannel(channel) && strings.EqualFold(strings.TrimPrefix(client.GeneralChannelName, "#"), channel.Name) {
+				return channel.ID
+			}
+		}
+	}
+
+	if client.GeneralChannelAuto {
+		if guild, err := fetchGuild(b, guildID); err == nil {
+			return guild.SystemChannelID
+		}
+	}
+
+	return ""
+}
+
+// announce sends a message to the guild's general channel, or does nothing if it has none
+func announce(b *Bot, guildID string, message string) {
+	channelID := generalChannel(b, guildID)
+	if channelID == "" {
+		b.l.Debug("no general channel, skipping announcement", "guild_id", guildID)
+		return
+	}
+	if err := b.discordClient.SendMessage(message, channelID); err != nil {
+		b.l.Error(err.Error(), "guild_id", guildID, "channel_id", channelID)
+	}
+}
+
+// fetchGuild returns a guild from the session's state, falling back to asking discord for it
+func fetchGuild(b *Bot, guildID string) (*discordgo.Guild, error) {
+	if guild, err := b.discordClient.Session.State.Guild(guildID); err == nil {
+		return guild, nil
+	}
+	return b.discordClient.Session.Guild(guildID)
+}
+
+// guildChannels returns a guild's channels from the session's state, falling back to asking discord for them
+func guildChannels(b *Bot, guildID string) ([]*discordgo.Channel, error) {
+	if guild, err := b.discordClient.Session.State.Guild(guildID); err == nil && len(guild.Channels) > 0 {
+		return guild.Channels, nil
+	}
+	return b.discordClient.Session.GuildChannels(guildID)
+}
+
+func MakeGuildCreateHandler(b *Bot) func(s *discordgo.Session, event *discordgo.GuildCreate) {
+	// Discord sends every guild again when the session reconnects, the bot only announces itself once
+	var mu sync.Mutex
+	announced := make(map[string]bool)
+
+	return func(s *discordgo.Session, event *discordgo.GuildCreate) {
+		b.l.Debug("called", "guild_id", event.ID, "handler", "guild_create")
+
+		if !b.inFlight.start() {
+			return
+		}
+		defer b.inFlight.done()
+
+		if event.Unavailable {
+			return
+		}
+
+		if err := syncCommands(b, event.ID); err != nil {
+			b.l.Error(err.Error(), "handler", "guild_create", "guild_id", event.ID)
+		}
+
+		// Catch up on channels created or deleted while the bot was offline
+		if err := reconcile(b, event.ID); err != nil {
+			b.l.Error(err.Error(), "handler", "guild_create", "guild_id", event.ID)
+		}
+
+		mu.Lock()
+		first := !announced[event.ID]
+		announced[event.ID] = true
+		mu.Unlock()
+
+		// TODO: Swap to user-friendly init message
+		if first {
+			announce(b, event.ID, "online")
+		}
+	}
+}
+
+func MakeGuildDeleteHandler(b *Bot) func(s *discordgo.Session, event *discordgo.GuildDelete) {
+	return func(s *discordgo.Session, event *discordgo.GuildDelete) {
+		b.l.Debug("called", "guild_id", event.ID, "handler", "guild_delete")
+
+		if !b.inFlight.start() {
+			return
+		}
+		defer b.inFlight.done()
+
+		// An unavailable guild is having an outage, the bot is still in it
+		if event.Unavailable || event.ID == "" {
+			return
+		}
+
+		for _, c := range b.conversations.inGuild(event.ID) {
+			if err := endConversation(b, c.ChannelID); err != nil {
+				b.l.Error(err.Error(), "handler", "guild_delete", "guild_id", event.ID, "channel_id", c.ChannelID)
+			}
+		}
+
+		if err := deleteGuild(*b, event.ID); err != nil {
+			b.l.Error(err.Error(), "handler", "guild_delete", "guild_id", event.ID)
+			return
+		}
+		b.l.Info("left guild", "guild_id", event.ID)
+	}
+}
+
+// serverCommand shows or changes the guild's settings
+func serverCommand() command {
+	minConversations := 0.0
+	return command{
+		definition: &discordgo.ApplicationCommand{
+			Name:                     "server",
+			Description:              "Show or change the bot's settings for this server",
+			DefaultMemberPermissions: &manageGuild,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show this server's settings",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set",
+					Description: "Change this server's settings",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:         discordgo.ApplicationCommandOptionChannel,
+							Name:         "general",
+							Description:  "Channel the bot announces itself in",
+							ChannelTypes: []discordgo.ChannelType{discordgo.ChannelTypeGuildText},
+						},
+						{
+							Type:         discordgo.ApplicationCommandOptionString,
+							Name:         "model",
+							Description:  "Model new conversations start with",
+							Autocomplete: true,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionInteger,
+							Name:        "max_conversations",
+							Description: "Conversations this server can hold at once, 0 for no limit",
+							MinValue:    &minConversations,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "reset",
+					Description: "Go back to the bot's default for a setting",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "setting",
+							Description: "Setting to reset",
+							Required:    true,
+							Choices: []*discordgo.ApplicationCommandOptionChoice{
+								{Name: "General channel", Value: "general"},
+								{Name: "Model", Value: "model"},
+								{Name: "Conversation limit", Value: "max_conversations"},
+							},
+						},
+					},
+				},
+			},
+		},
+		handler: func(b *Bot, i *discordgo.InteractionCreate, opts commandOptions) error {
+			if i.GuildID == "" {
+				return userError("This command can only be used in a server.")
+			}
+
+			g, err := selectGuild(*b, i.GuildID)
+			if err != nil {
+				return err
+			}
+
+			switch opts.subcommand {
+			case "show":
+				respondEphemeral(b, i, formatGuildSettings(b, g))
+				return nil
+			case "set":
+				general, hasGeneral := opts.options["general"]
+				model, hasModel := opts.String("model")
+				maxConversations, hasMax := opts.Int("max_conversations")
+				if !hasGeneral && !hasModel && !hasMax {
+					return userError("Pick at least one setting to change.")
+				}
+
+				if hasGeneral {
+					g.GeneralChannel = general.ChannelValue(nil).ID
+				}
+				if hasModel {
+					g.DefaultModel = openai.Model(strings.TrimSpace(model))
+					if err := checkModel(b, g.DefaultModel); err != nil {
+						return err
+					}
+				}
+				if hasMax {
+					g.MaxConversations = int(maxConversations)
+				}
+			case "reset":
+				setting, _ := opts.String("setting")
+				switch setting {
+				case "general":
+					g.GeneralChannel = ""
+				case "model":
+					g.DefaultModel = ""
+				case "max_conversations":
+					g.MaxConversations = 0
+				}
+			default:
+				return fmt.Errorf("unknown subcommand %q", opts.subcommand)
+			}
+
+			if err := upsertGuild(*b, g); err != nil {
+				return err
+			}
+
+			respondEphemeral(b, i, formatGuildSettings(b, g))
+			return nil
+		},
+		autocomplete: func(b *Bot, i *discordgo.InteractionCreate, focused string, opts commandOptions) []*discordgo.ApplicationCommandOptionChoice {
+			models, err := b.models.get(b)
+			if err != nil {
+				b.l.Warn(err.Error(), "command", "server", "guild_id", i.GuildID)
+				return nil
+			}
+
+			typed, _ := opts.String(focused)
+			return modelChoices(models, typed)
+		},
+	}
+}
+
+func formatGuildSettings(b *Bot, g guildSettings) string {
+	var sb strings.Builder
+
+	if channelID := generalChannel(b, g.GuildID); channelID != "" {
+		sb.WriteString(fmt.Sprintf("**General channel:** <#%s>\n", channelID))
+	} else {
+		sb.WriteString("**General channel:** none found, the bot doesn't announce itself\n")
+	}
+
+	if g.DefaultModel != "" {
+		sb.WriteString(fmt.Sprintf("**Default model:** `%s`\n", g.DefaultModel))
+	} else {
+		sb.WriteString(fmt.Sprintf("**Default model:** `%s` (bot default)\n", b.config.defaultModel))
+	}
+
+	if g.DefaultPreset != "" {
+		sb.WriteString(fmt.Sprintf("**Default preset:** `%s`\n", g.DefaultPreset))
+	} else {
+		sb.WriteString("**Default preset:** none\n")
+	}
+
+	conversations := len(b.conversations.inGuild(g.GuildID))
+	if g.MaxConversations > 0 {
+		sb.WriteString(fmt.Sprintf("**Conversations:** %d of %d", conversations, g.MaxConversations))
+	} else {
+		sb.WriteString(fmt.Sprintf("**Conversations:** %d, no limit", conversations))
+	}
+
+	return sb.String()
+}
@@ -1,9 +1,11 @@
 package bot
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"github.com/bwmarrin/discordgo"
 	"github.com/mdesson/chatcord/openai"
-	"github.com/mdesson/chatcord/util"
 	"time"
 )
 
@@ -11,81 +13,235 @@ func MakeChannelCreateHandler(b *Bot) func(s *discordgo.Session, event *discordg
 	return func(s *discordgo.Session, event *discordgo.ChannelCreate) {
 		b.l.Debug("called", "channel_id", event.ID, "handler", "channel_create")
 
-		// TODO: Use a system default prompt.
-		c := conversation{
-			ChannelID:    event.Channel.ID,
-			Conversation: openai.NewConversation(openai.GPT_4_TURBO, "You are a helpful assistant. If you need to use formatting, send it with discord-flavoured markdown.", b.openAIClient),
+		if !b.inFlight.start() {
+			return
 		}
+		defer b.inFlight.done()
 
-		if err := createConvoMessageUsage(*b, c); err != nil {
-			b.l.Error(err.Error(), "handler", "channel_create")
+		// Only channels matching the configured rules are picked up, others need /chat enable
+		if !isEligible(b, event.Channel, nil) {
 			return
 		}
 
-		b.conversations[event.ID] = &c
+		if _, err := startConversation(b, event.Channel); err != nil {
+			b.l.Error(err.Error(), "handler", "channel_create", "channel_id", event.ID)
+		}
 	}
 }
 
 func MakeMessageCreateHandler(b *Bot) func(s *discordgo.Session, event *discordgo.MessageCreate) {
 	return func(s *discordgo.Session, event *discordgo.MessageCreate) {
 		b.l.Debug("called", "channel_id", event, "handler", "message_create")
-		
+
 		// Ignore messages sent by the bot
 		if event.Author.Bot {
 			return
 		}
 
-		c, ok := b.conversations[event.ChannelID]
+		// Direct messages are ignored altogether when they are turned off
+		dm := event.GuildID == ""
+		if dm && !b.config.dmEnabled {
+			return
+		}
+
+		content := event.Content
+		c, ok := b.conversations.get(event.ChannelID)
+
+		// ignore conversations we are not watching, unless they can be started with this message
+		if !ok && !dm && !startsThread(b, event.Message) {
+			return
+		}
 
-		// ignore conversations we are not watching
-		if !ok {
+		// Don't start new requests while shutting down
+		if !b.inFlight.start() {
 			return
 		}
+		defer b.inFlight.done()
 
-		// Set typing while openAI processes API request
-		done := make(chan bool)
-		go func() {
-			for {
-				select {
-				case <-done:
-					return
-				default:
-					if err := b.discordClient.Session.ChannelTyping(event.ChannelID); err != nil {
+		var err error
+		switch {
+		case !ok && dm:
+			c, err = startDM(b, event.Message)
+		case !ok:
+			content = stripMention(content, s.State.User.ID)
+			c, err = startThread(b, event.Message, content)
+		default:
+			if content, ok = addressed(b, c, event.Message); !ok {
+				// Not meant for the bot, but it may still be worth remembering
+				if c.policy().RecordContext {
+					if err := recordContext(b, c, userMessage(event.Message, event.Content)); err != nil {
 						b.l.Error(err.Error(), "handler", "message_create", "channel_id", event.ChannelID)
-						return
 					}
-					time.Sleep(3 * time.Second)
 				}
+				return
 			}
-		}()
-
-		if msg, err := c.Chat(event.Content); err != nil {
-			done <- true
-			b.l.Error(err.Error(), "handler", "message_create", "channel_id", event.ChannelID)
-		} else {
-			done <- true
-			for _, chunk := range util.ChunkText(msg) {
-				if err := b.discordClient.SendMessage(chunk, event.ChannelID); err != nil {
-					b.l.Error(err.Error(), "handler", "message_create", "channel_id", event.ChannelID)
-				}
-			}
-			// After successfully sending message, update db with user message and bot response
-			// TODO: This should really be done as a transaction.
-			userMsg := c.Messages[len(c.Messages)-2]
-			botMsg := c.Messages[len(c.Messages)-1]
-
-			if err := insertMessage(*b, event.ChannelID, userMsg); err != nil {
+		}
+		if errors.Is(err, errConversationLimit) {
+			if err := b.discordClient.SendMessage(conversationLimitMessage, event.ChannelID); err != nil {
 				b.l.Error(err.Error(), "handler", "message_create", "channel_id", event.ChannelID)
 			}
+			return
+		}
+		if err != nil {
+			b.l.Error(err.Error(), "handler", "message_create", "channel_id", event.ChannelID)
+			return
+		}
 
-			if err := insertMessage(*b, event.ChannelID, botMsg); err != nil {
-				b.l.Error(err.Error(), "handler", "message_create", "channel_id", event.ChannelID)
-			}
+		if dm && dmQuotaReached(b, event.Author.ID, event.ChannelID) {
+			return
+		}
 
-			if err := updateUsage(*b, event.ChannelID, c.Usage); err != nil {
-				b.l.Error(err.Error(), "handler", "message_create", "channel_id", event.ChannelID)
+		if reply(b, c, userMessage(event.Message, content)) && dm {
+			countDM(b, event.Author.ID)
+		}
+	}
+}
+
+// startsThread reports whether the message should start a conversation in a new thread: thread mode must be on, and
+// the message must mention the bot in a text channel
+func startsThread(b *Bot, message *discordgo.Message) bool {
+	if !b.config.threadMode || message.GuildID == "" || !mentionsUser(message, b.discordClient.Session.State.User.ID) {
+		return false
+	}
+
+	channel, err := fetchChannel(b, message.ChannelID)
+	if err != nil {
+		b.l.Error(err.Error(), "handler", "message_create", "channel_id", message.ChannelID)
+		return false
+	}
+	return isTextChannel(channel)
+}
+
+// reply answers the message in the conversation, then stores the exchange. It reports whether the bot answered.
+func reply(b *Bot, c *conversation, message openai.Message) bool {
+	if tokens, err := c.PromptTokens(message.Content); err != nil {
+		b.l.Warn(err.Error(), "handler", "message_create", "channel_id", c.ChannelID)
+	} else {
+		b.l.Debug("sending prompt", "handler", "message_create", "channel_id", c.ChannelID, "prompt_tokens", tokens)
+	}
+
+	var (
+		exchange openai.Exchange
+		err      error
+	)
+	if c.streams() {
+		exchange, err = streamReply(b, c, func() (chan string, chan openai.StreamResult, error) { return c.ChatStream(b.ctx, message) }, nil)
+	} else {
+		exchange, err = sendReply(b, c, func() (openai.Exchange, error) { return c.Chat(b.ctx, message) }, nil)
+	}
+	if err != nil {
+		b.l.Error(err.Error(), "handler", "message_create", "channel_id", c.ChannelID)
+		// The bot is shutting down, there is nobody to tell
+		if errors.Is(err, context.Canceled) {
+			return false
+		}
+		if err := b.discordClient.SendMessage(userErrorMessage(err), c.ChannelID); err != nil {
+			b.l.Error(err.Error(), "handler", "message_create", "channel_id", c.ChannelID)
+		}
+		return false
+	}
+
+	// After successfully getting a response, update db with user message and bot response as they were stored, other
+	// messages may have been recorded since
+	if err := insertExchange(*b, c.ChannelID, exchange.User, exchange.Reply, exchange.Usage); err != nil {
+		b.l.Error(err.Error(), "handler", "message_create", "channel_id", c.ChannelID)
+		return true
+	}
+	if err := updateLatestReply(*b, c); err != nil {
+		b.l.Error(err.Error(), "handler", "message_create", "channel_id", c.ChannelID)
+	}
+
+	// Fold older turns into the summary once the conversation grows long, ready for the next message
+	summary, err := c.Summarize(b.ctx)
+	if err != nil {
+		b.l.Error(err.Error(), "handler", "message_create", "channel_id", c.ChannelID)
+	} else if summary != nil {
+		b.l.Debug("summarized conversation", "handler", "message_create", "channel_id", c.ChannelID, "start_idx", summary.StartIndex, "end_idx", summary.EndIndex)
+		if err := insertSummary(*b, c.ChannelID, *summary); err != nil {
+			b.l.Error(err.Error(), "handler", "message_create", "channel_id", c.ChannelID)
+		}
+	}
+
+	return true
+}
+
+// sendReply gets the whole response from OpenAI with chat, then posts it to the channel, rewriting the messages of the
+// previous reply if given. The reply's messages are remembered as the conversation's latest.
+func sendReply(b *Bot, c *conversation, chat func() (openai.Exchange, error), previous []string) (openai.Exchange, error) {
+	// Set typing while openAI processes API request. done is closed rather than sent on, as the loop may have given up.
+	done := make(chan struct{})
+	go func() {
+		ticker := time.NewTicker(3 * time.Second)
+		defer ticker.Stop()
+		for {
+			if err := b.discordClient.Session.ChannelTyping(c.ChannelID); err != nil {
+				b.l.Error(err.Error(), "channel_id", c.ChannelID)
+				return
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
 			}
 		}
+	}()
+
+	exchange, err := chat()
+	close(done)
+	if err != nil {
+		return openai.Exchange{}, err
+	}
+
+	ids, err := b.discordClient.SendReply(exchange.Reply.Content, c.ChannelID, previous, regenerateButton)
+	if err != nil {
+		b.l.Error(err.Error(), "channel_id", c.ChannelID)
+	}
+	c.setLatestReply(exchange.Reply.Index, ids)
+	return exchange, nil
+}
+
+// streamReply streams the response from OpenAI with chat into the channel, editing the reply as tokens arrive and
+// rewriting the messages of the previous reply if given. The reply's messages are remembered as the conversation's
+// latest once the response is complete.
+func streamReply(b *Bot, c *conversation, chat func() (chan string, chan openai.StreamResult, error), previous []string) (openai.Exchange, error) {
+	chunks, results, err := chat()
+	if err != nil {
+		return openai.Exchange{}, err
+	}
+
+	ids, err := b.discordClient.StreamMessage(chunks, c.ChannelID, previous, regenerateButton)
+	if err != nil {
+		b.l.Error(err.Error(), "channel_id", c.ChannelID)
+		// Keep reading so the conversation still records the full response
+		for range chunks {
+		}
+	}
+
+	result := <-results
+	if result.Err != nil {
+		return openai.Exchange{}, result.Err
+	}
+	c.setLatestReply(result.Reply.Index, ids)
+	return result.Exchange, nil
+}
+
+func MakeChannelUpdateHandler(b *Bot) func(s *discordgo.Session, event *discordgo.ChannelUpdate) {
+	return func(s *discordgo.Session, event *discordgo.ChannelUpdate) {
+		b.l.Debug("called", "channel_id", event.ID, "handler", "channel_update")
+
+		if !b.inFlight.start() {
+			return
+		}
+		defer b.inFlight.done()
+
+		c, ok := b.conversations.get(event.ID)
+		if !ok || !c.followsTopic() {
+			return
+		}
+
+		if err := syncTopicPrompt(b, c, event.Channel); err != nil {
+			b.l.Error(err.Error(), "handler", "channel_update", "channel_id", event.ID)
+		}
 	}
 }
 
@@ -93,13 +249,71 @@ func MakeChannelDeleteHandler(b *Bot) func(s *discordgo.Session, event *discordg
 	return func(s *discordgo.Session, event *discordgo.ChannelDelete) {
 		b.l.Debug("called", "channel_id", event, "handler", "channel_delete")
 
-		// Remove from database
-		if err := deleteConvoMessageUsage(*b, event.ID); err != nil {
+		if !b.inFlight.start() {
+			return
+		}
+		defer b.inFlight.done()
+
+		if _, ok := b.conversations.get(event.ID); !ok {
+			return
+		}
+
+		if err := endConversation(b, event.ID); err != nil {
 			b.l.Error(err.Error(), "handler", "channel_delete", "channel_id", event.ID)
-		} else {
-			// On success, remove from memory
-			delete(b.conversations, event.ID)
 		}
+	}
+}
 
+func MakeThreadUpdateHandler(b *Bot) func(s *discordgo.Session, event *discordgo.ThreadUpdate) {
+	return func(s *discordgo.Session, event *discordgo.ThreadUpdate) {
+		b.l.Debug("called", "channel_id", event.ID, "handler", "thread_update")
+
+		if !b.inFlight.start() {
+			return
+		}
+		defer b.inFlight.done()
+
+		// An archived thread is treated as deleted, as the conversation is over
+		if event.ThreadMetadata == nil || !event.ThreadMetadata.Archived {
+			return
+		}
+		if _, ok := b.conversations.get(event.ID); !ok {
+			return
+		}
+
+		if err := endConversation(b, event.ID); err != nil {
+			b.l.Error(err.Error(), "handler", "thread_update", "channel_id", event.ID)
+		}
+	}
+}
+
+func MakeThreadDeleteHandler(b *Bot) func(s *discordgo.Session, event *discordgo.ThreadDelete) {
+	return func(s *discordgo.Session, event *discordgo.ThreadDelete) {
+		b.l.Debug("called", "channel_id", event.ID, "handler", "thread_delete")
+
+		if !b.inFlight.start() {
+			return
+		}
+		defer b.inFlight.done()
+
+		if _, ok := b.conversations.get(event.ID); !ok {
+			return
+		}
+
+		if err := endConversation(b, event.ID); err != nil {
+			b.l.Error(err.Error(), "handler", "thread_delete", "channel_id", event.ID)
+		}
+	}
+}
+
+// retryNotifier lets the channel know when a request to OpenAI failed and is being retried
+func retryNotifier(b *Bot, channelID string) openai.RetryFunc {
+	return func(attempt int, delay time.Duration, err error) {
+		b.l.Warn(err.Error(), "channel_id", channelID, "attempt", attempt, "delay", delay.String())
+
+		msg := fmt.Sprintf("⏳ OpenAI is busy, retrying in %s (attempt %d)...", delay.Round(100*time.Millisecond), attempt)
+		if err := b.discordClient.SendMessage(msg, channelID); err != nil {
+			b.l.Error(err.Error(), "channel_id", channelID)
+		}
 	}
 }
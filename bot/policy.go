@@ -0,0 +1,135 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/mdesson/chatcord/openai"
+	"strings"
+)
+
+// responsePolicy is which messages in a conversation the bot answers
+type responsePolicy string
+
+const (
+	POLICY_ALWAYS  responsePolicy = "always"  // Every message
+	POLICY_MENTION responsePolicy = "mention" // Messages mentioning the bot
+	POLICY_REPLY   responsePolicy = "reply"   // Replies to one of the bot's messages
+	POLICY_PREFIX  responsePolicy = "prefix"  // Messages starting with the conversation's prefix
+)
+
+// policySettings are which messages a conversation answers, and whether it remembers the others
+type policySettings struct {
+	Policy        responsePolicy
+	Prefix        string
+	RecordContext bool
+}
+
+// valid reports whether p is one of the known policies
+func (p responsePolicy) valid() bool {
+	switch p {
+	case POLICY_ALWAYS, POLICY_MENTION, POLICY_REPLY, POLICY_PREFIX:
+		return true
+	default:
+		return false
+	}
+}
+
+var policyChoices = []*discordgo.ApplicationCommandOptionChoice{
+	{Name: "Every message", Value: string(POLICY_ALWAYS)},
+	{Name: "Only when mentioned", Value: string(POLICY_MENTION)},
+	{Name: "Only replies to the bot", Value: string(POLICY_REPLY)},
+	{Name: "Only messages starting with the prefix", Value: string(POLICY_PREFIX)},
+}
+
+// addressed reports whether the message is meant for the bot under the conversation's response policy, returning its
+// content without the mention or prefix used to call the bot
+func addressed(b *Bot, c *conversation, message *discordgo.Message) (string, bool) {
+	botID := b.discordClient.Session.State.User.ID
+	p := c.policy()
+
+	switch p.Policy {
+	case POLICY_MENTION:
+		if !mentionsUser(message, botID) {
+			return "", false
+		}
+		return stripMention(message.Content, botID), true
+	case POLICY_REPLY:
+		ref := message.ReferencedMessage
+		if ref == nil || ref.Author == nil || ref.Author.ID != botID {
+			return "", false
+		}
+		return message.Content, true
+	case POLICY_PREFIX:
+		if p.Prefix == "" || !strings.HasPrefix(message.Content, p.Prefix) {
+			return "", false
+		}
+		return strings.TrimSpace(strings.TrimPrefix(message.Content, p.Prefix)), true
+	default:
+		return message.Content, true
+	}
+}
+
+// recordContext adds a message the bot wasn't asked to answer to the conversation, so later replies can refer to it
+func recordContext(b *Bot, c *conversation, message openai.Message) error {
+	if strings.TrimSpace(message.Content) == "" {
+		return nil
+	}
+	return insertMessage(*b, c.ChannelID, c.AddMessage(message))
+}
+
+// policySubcommand shows or changes which messages the conversation answers
+func policySubcommand(b *Bot, i *discordgo.InteractionCreate, c *conversation, opts commandOptions) error {
+	policy, hasPolicy := opts.String("mode")
+	prefix, hasPrefix := opts.String("prefix")
+	record, hasRecord := opts.Bool("record")
+
+	if !hasPolicy && !hasPrefix && !hasRecord {
+		respondEphemeral(b, i, fmt.Sprintf("This conversation answers %s.", formatPolicy(c.policy())))
+		return nil
+	}
+
+	// Only change the conversation once the new settings are known to work together
+	p := c.policy()
+	if hasPolicy {
+		p.Policy = responsePolicy(policy)
+	}
+	if hasPrefix {
+		p.Prefix = strings.TrimSpace(prefix)
+	}
+	if hasRecord {
+		p.RecordContext = record
+	}
+	if !p.Policy.valid() {
+		return userError("Unknown mode %q.", p.Policy)
+	}
+	if p.Policy == POLICY_PREFIX && p.Prefix == "" {
+		return userError("Set a prefix to answer messages starting with it.")
+	}
+
+	if err := updateResponsePolicy(*b, c.ChannelID, p); err != nil {
+		return err
+	}
+	c.setPolicy(p)
+
+	respond(b, i, fmt.Sprintf("This conversation now answers %s.", formatPolicy(p)))
+	return nil
+}
+
+func formatPolicy(p policySettings) string {
+	var s string
+	switch p.Policy {
+	case POLICY_MENTION:
+		s = "messages mentioning the bot"
+	case POLICY_REPLY:
+		s = "replies to the bot"
+	case POLICY_PREFIX:
+		s = fmt.Sprintf("messages starting with `%s`", p.Prefix)
+	default:
+		return "every message"
+	}
+
+	if p.RecordContext {
+		return s + ", and remembers the others as context"
+	}
+	return s + ", and ignores the others"
+}
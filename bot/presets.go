@@ -0,0 +1,279 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"strings"
+)
+
+// builtinPresets are available in every guild, and can be overridden by a guild preset of the same name
+var builtinPresets = map[string]string{
+	"assistant":  defaultSystemPrompt,
+	"coder":      "You are an expert software engineer. Answer with correct, idiomatic code and brief explanations. Put code in fenced code blocks tagged with their language, and point out edge cases and pitfalls.",
+	"translator": "You are a translator. Translate each message into English, or into French if it is already in English. Keep the tone and formatting of the original and reply with the translation only.",
+	"reviewer":   "You are a meticulous code reviewer. Point out bugs, security issues, unclear naming and missing tests in the code you are given, most important first, and suggest concrete fixes. Use discord-flavoured markdown.",
+	"writer":     "You are an editor. Improve the clarity, grammar and flow of the text you are given while keeping its meaning and voice. Reply with the revised text followed by a short list of the main changes.",
+}
+
+// preset is a named system prompt
+type preset struct {
+	GuildID string // Empty for built-in presets
+	Name    string
+	Prompt  string
+}
+
+// manageGuild is the permission needed to change a guild's presets
+var manageGuild int64 = discordgo.PermissionManageServer
+
+// guildDefaultPrompt returns the prompt of the guild's default preset, or the bot's default prompt if it has none
+func guildDefaultPrompt(b *Bot, guildID string) string {
+	name, err := selectGuildDefaultPreset(*b, guildID)
+	if err != nil {
+		b.l.Error(err.Error(), "guild_id", guildID)
+		return defaultSystemPrompt
+	}
+	if name == "" {
+		return defaultSystemPrompt
+	}
+
+	p, ok, err := selectPreset(*b, guildID, name)
+	if err != nil {
+		b.l.Error(err.Error(), "guild_id", guildID)
+		return defaultSystemPrompt
+	}
+	if !ok {
+		b.l.Warn("default preset no longer exists", "guild_id", guildID, "preset", name)
+		return defaultSystemPrompt
+	}
+	return p.Prompt
+}
+
+// presetCommand manages the guild's system prompt presets
+func presetCommand() command {
+	nameOption := func(description string) *discordgo.ApplicationCommandOption {
+		return &discordgo.ApplicationCommandOption{
+			Type:         discordgo.ApplicationCommandOptionString,
+			Name:         "name",
+			Description:  description,
+			Required:     true,
+			Autocomplete: true,
+		}
+	}
+
+	return command{
+		definition: &discordgo.ApplicationCommand{
+			Name:                     "preset",
+			Description:              "Manage system prompt presets",
+			DefaultMemberPermissions: &manageChannels,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "list",
+					Description: "List the available presets",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show a preset's prompt",
+					Options:     []*discordgo.ApplicationCommandOption{nameOption("Preset to show")},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "apply",
+					Description: "Use a preset as this channel's system prompt",
+					Options:     []*discordgo.ApplicationCommandOption{nameOption("Preset to apply")},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "save",
+					Description: "Create or replace a preset, leave the prompt out to write a long one in a form",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "name",
+							Description: "Name of the preset",
+							Required:    true,
+							MaxLength:   32,
+						},
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "prompt",
+							Description: "The preset's system prompt",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "delete",
+					Description: "Delete one of this server's presets",
+					Options:     []*discordgo.ApplicationCommandOption{nameOption("Preset to delete")},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "default",
+					Description: "Show or change the preset new channels start with",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:         discordgo.ApplicationCommandOptionString,
+							Name:         "name",
+							Description:  "Preset new channels should start with",
+							Autocomplete: true,
+						},
+					},
+				},
+			},
+		},
+		handler: func(b *Bot, i *discordgo.InteractionCreate, opts commandOptions) error {
+			name, hasName := opts.String("name")
+			name = strings.ToLower(strings.TrimSpace(name))
+
+			// Presets are shared by the whole guild, so changing them takes more than managing a channel
+			changesPresets := opts.subcommand == "save" || opts.subcommand == "delete" || (opts.subcommand == "default" && hasName)
+			if changesPresets && !hasPermissions(i, &manageGuild) {
+				return userError("You need the Manage Server permission to change presets.")
+			}
+
+			switch opts.subcommand {
+			case "list":
+				presets, err := selectPresets(*b, i.GuildID)
+				if err != nil {
+					return err
+				}
+				defaultName, err := selectGuildDefaultPreset(*b, i.GuildID)
+				if err != nil {
+					return err
+				}
+
+				var sb strings.Builder
+				sb.WriteString("Available presets:\n")
+				for _, p := range presets {
+					sb.WriteString("- `" + p.Name + "`")
+					if p.GuildID == "" {
+						sb.WriteString(" (built-in)")
+					}
+					if p.Name == defaultName {
+						sb.WriteString(" (default)")
+					}
+					sb.WriteString("\n")
+				}
+				respondEphemeral(b, i, sb.String())
+				return nil
+			case "show":
+				p, err := findPreset(b, i.GuildID, name)
+				if err != nil {
+					return err
+				}
+				respondEphemeral(b, i, formatPrompt(fmt.Sprintf("Preset `%s`:", p.Name), p.Prompt))
+				return nil
+			case "apply":
+				c, ok := b.conversations.get(i.ChannelID)
+				if !ok {
+					return userError("This channel isn't a conversation.")
+				}
+				p, err := findPreset(b, i.GuildID, name)
+				if err != nil {
+					return err
+				}
+				return setSystemPrompt(b, i, c, p.Prompt)
+			case "save":
+				if name == "" || strings.ContainsAny(name, ": ") {
+					return userError("Preset names can't be empty or contain spaces or colons.")
+				}
+				prompt, ok := opts.String("prompt")
+				if !ok {
+					current := ""
+					if p, found, err := selectPreset(*b, i.GuildID, name); err == nil && found {
+						current = p.Prompt
+					}
+					return openModal(b, i, "preset:"+name, "Preset "+name, "Prompt", current)
+				}
+				return savePreset(b, i, name, prompt)
+			case "delete":
+				deleted, err := deletePreset(*b, i.GuildID, name)
+				if err != nil {
+					return err
+				}
+				if !deleted {
+					return userError("This server has no preset named `%s`. Built-in presets can't be deleted.", name)
+				}
+				respondEphemeral(b, i, fmt.Sprintf("Deleted preset `%s`.", name))
+				return nil
+			case "default":
+				if !hasName {
+					defaultName, err := selectGuildDefaultPreset(*b, i.GuildID)
+					if err != nil {
+						return err
+					}
+					if defaultName == "" {
+						respondEphemeral(b, i, "New channels start with the bot's default prompt.")
+					} else {
+						respondEphemeral(b, i, fmt.Sprintf("New channels start with the `%s` preset.", defaultName))
+					}
+					return nil
+				}
+				p, err := findPreset(b, i.GuildID, name)
+				if err != nil {
+					return err
+				}
+				if err := upsertGuildDefaultPreset(*b, i.GuildID, p.Name); err != nil {
+					return err
+				}
+				respondEphemeral(b, i, fmt.Sprintf("New channels will start with the `%s` preset.", p.Name))
+				return nil
+			default:
+				return fmt.Errorf("unknown subcommand %q", opts.subcommand)
+			}
+		},
+		autocomplete: func(b *Bot, i *discordgo.InteractionCreate, focused string, opts commandOptions) []*discordgo.ApplicationCommandOptionChoice {
+			presets, err := selectPresets(*b, i.GuildID)
+			if err != nil {
+				b.l.Error(err.Error(), "command", "preset", "guild_id", i.GuildID)
+				return nil
+			}
+
+			typed, _ := opts.String(focused)
+			var choices []*discordgo.ApplicationCommandOptionChoice
+			for _, p := range presets {
+				// Only the guild's own presets can be deleted
+				if opts.subcommand == "delete" && p.GuildID == "" {
+					continue
+				}
+				if strings.Contains(p.Name, strings.ToLower(typed)) {
+					choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: p.Name, Value: p.Name})
+				}
+			}
+			return choices
+		},
+		modal: func(b *Bot, i *discordgo.InteractionCreate, data discordgo.ModalSubmitInteractionData) error {
+			if !hasPermissions(i, &manageGuild) {
+				return userError("You need the Manage Server permission to change presets.")
+			}
+			_, name, _ := strings.Cut(data.CustomID, ":")
+			return savePreset(b, i, name, modalText(data))
+		},
+	}
+}
+
+// findPreset looks up a preset by name, returning a user error if there is none
+func findPreset(b *Bot, guildID string, name string) (preset, error) {
+	p, ok, err := selectPreset(*b, guildID, name)
+	if err != nil {
+		return preset{}, err
+	}
+	if !ok {
+		return preset{}, userError("There is no preset named `%s`.", name)
+	}
+	return p, nil
+}
+
+// savePreset creates or replaces one of the guild's presets, then confirms it to the member
+func savePreset(b *Bot, i *discordgo.InteractionCreate, name string, prompt string) error {
+	if strings.TrimSpace(prompt) == "" {
+		return userError("The prompt can't be empty.")
+	}
+	if err := upsertPreset(*b, preset{GuildID: i.GuildID, Name: name, Prompt: prompt}); err != nil {
+		return err
+	}
+	respondEphemeral(b, i, formatPrompt(fmt.Sprintf("Saved preset `%s`:", name), prompt))
+	return nil
+}
@@ -0,0 +1,145 @@
+package bot
+
+import (
+	"context"
+	"errors"
+	"github.com/bwmarrin/discordgo"
+	"github.com/mdesson/chatcord/openai"
+)
+
+// regenerateEmoji regenerates a reply when it is reacted with, and is shown on the regenerate button
+const regenerateEmoji = "🔁"
+
+// regenerateButton is attached to every reply, so a bad one can be regenerated without asking again
+var regenerateButton = []discordgo.MessageComponent{
+	discordgo.ActionsRow{Components: []discordgo.MessageComponent{
+		discordgo.Button{
+			CustomID: "regenerate",
+			Label:    "Regenerate",
+			Style:    discordgo.SecondaryButton,
+			Emoji:    discordgo.ComponentEmoji{Name: regenerateEmoji},
+		},
+	}},
+}
+
+// isLatestReply reports whether the discord message is part of the conversation's latest reply, and nothing has been
+// said after it
+func isLatestReply(c *conversation, messageID string) bool {
+	index, ids := c.latestReply()
+	if index != c.LastIndex() {
+		return false
+	}
+	for _, id := range ids {
+		if id == messageID {
+			return true
+		}
+	}
+	return false
+}
+
+// regenerate discards the conversation's latest reply and asks for a new one, editing the reply's messages in place. It
+// reports whether the reply was regenerated. Its callers are tracked in b.inFlight.
+func regenerate(b *Bot, c *conversation) bool {
+	var (
+		exchange openai.Exchange
+		err      error
+	)
+	index, previous := c.latestReply()
+	if c.streams() {
+		exchange, err = streamReply(b, c, func() (chan string, chan openai.StreamResult, error) { return c.RegenerateStream(b.ctx, index) }, previous)
+	} else {
+		exchange, err = sendReply(b, c, func() (openai.Exchange, error) { return c.Regenerate(b.ctx, index) }, previous)
+	}
+	if err != nil {
+		b.l.Error(err.Error(), "channel_id", c.ChannelID)
+		// The bot is shutting down, there is nobody to tell
+		if errors.Is(err, context.Canceled) {
+			return false
+		}
+		if err := b.discordClient.SendMessage(userErrorMessage(err), c.ChannelID); err != nil {
+			b.l.Error(err.Error(), "channel_id", c.ChannelID)
+		}
+		return false
+	}
+
+	// The new reply takes the place of the old one in the db too
+	if err := replaceReply(*b, c.ChannelID, exchange.Reply, exchange.Usage); err != nil {
+		b.l.Error(err.Error(), "channel_id", c.ChannelID)
+	}
+	if err := updateLatestReply(*b, c); err != nil {
+		b.l.Error(err.Error(), "channel_id", c.ChannelID)
+	}
+	return true
+}
+
+func MakeMessageReactionAddHandler(b *Bot) func(s *discordgo.Session, event *discordgo.MessageReactionAdd) {
+	return func(s *discordgo.Session, event *discordgo.MessageReactionAdd) {
+		b.l.Debug("called", "channel_id", event.ChannelID, "handler", "message_reaction_add")
+
+		if !b.inFlight.start() {
+			return
+		}
+		defer b.inFlight.done()
+
+		if event.Emoji.Name != regenerateEmoji || event.UserID == s.State.User.ID {
+			return
+		}
+
+		c, ok := b.conversations.get(event.ChannelID)
+		if !ok || !isLatestReply(c, event.MessageID) {
+			return
+		}
+
+		// Take the reaction off so the reply can be regenerated the same way again, bots can't in direct messages
+		if event.GuildID != "" {
+			if err := s.MessageReactionRemove(event.ChannelID, event.MessageID, event.Emoji.APIName(), event.UserID); err != nil {
+				b.l.Warn(err.Error(), "handler", "message_reaction_add", "channel_id", event.ChannelID)
+			}
+		}
+
+		regenerate(b, c)
+	}
+}
+
+// regenerateCommand discards the conversation's latest reply and asks for a new one, also run by the button on replies
+func regenerateCommand() command {
+	return command{
+		definition: &discordgo.ApplicationCommand{
+			Name:        "regenerate",
+			Description: "Replace the latest reply in this channel's conversation with a new one",
+		},
+		handler: func(b *Bot, i *discordgo.InteractionCreate, opts commandOptions) error {
+			c, ok := b.conversations.get(i.ChannelID)
+			if !ok {
+				return userError("This channel isn't a conversation.")
+			}
+			if index, ids := c.latestReply(); len(ids) == 0 || index != c.LastIndex() {
+				return userError("There's no reply to regenerate yet.")
+			}
+
+			respondEphemeral(b, i, regenerateEmoji+" Regenerating the latest reply.")
+			regenerate(b, c)
+			return nil
+		},
+		component: func(b *Bot, i *discordgo.InteractionCreate, data discordgo.MessageComponentInteractionData) error {
+			c, ok := b.conversations.get(i.ChannelID)
+			if !ok {
+				return userError("This channel isn't a conversation anymore.")
+			}
+			if !isLatestReply(c, i.Message.ID) {
+				return userError("Only the latest reply can be regenerated.")
+			}
+
+			// Acknowledge the click straight away, the reply is edited in place once the new one arrives
+			err := b.discordClient.Session.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+				Type: discordgo.InteractionResponseDeferredMessageUpdate,
+			})
+			if err != nil {
+				return err
+			}
+
+			regenerate(b, c)
+			return nil
+		},
+	}
+}
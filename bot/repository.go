@@ -2,8 +2,11 @@ package bot
 
 import (
 	"database/sql"
+	"errors"
+	"fmt"
 	_ "github.com/mattn/go-sqlite3"
 	"github.com/mdesson/chatcord/openai"
+	"strings"
 )
 
 func initDB() (*sql.DB, error) {
@@ -37,6 +40,30 @@ func initDB() (*sql.DB, error) {
         prompt_tokens INTEGER,
         total_tokens INTEGER,
         FOREIGN KEY (channel_id) REFERENCES conversations (channel_id)
+    );
+    CREATE TABLE IF NOT EXISTS summaries (
+        channel_id TEXT,
+        start_idx INTEGER NOT NULL,
+        end_idx INTEGER NOT NULL,
+        content TEXT,
+        FOREIGN KEY (channel_id) REFERENCES conversations (channel_id),
+        UNIQUE (end_idx, channel_id)
+    );
+    CREATE TABLE IF NOT EXISTS presets (
+        guild_id TEXT NOT NULL,
+        name TEXT NOT NULL,
+        prompt TEXT,
+        PRIMARY KEY (guild_id, name)
+    );
+    CREATE TABLE IF NOT EXISTS guilds (
+        guild_id TEXT PRIMARY KEY,
+        default_preset TEXT NOT NULL DEFAULT ''
+    );
+    CREATE TABLE IF NOT EXISTS dm_quotas (
+        user_id TEXT NOT NULL,
+        day TEXT NOT NULL,
+        count INTEGER NOT NULL DEFAULT 0,
+        PRIMARY KEY (user_id, day)
     );`
 
 	_, err = db.Exec(createStmt)
@@ -44,9 +71,95 @@ func initDB() (*sql.DB, error) {
 		return nil, err
 	}
 
+	// Columns added after the initial schema, which CREATE TABLE IF NOT EXISTS won't add to existing databases
+	if err := addColumn(db, "conversations", "base_url", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "conversations", "stream", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "conversations", "topic_prompt", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "conversations", "kind", "TEXT NOT NULL DEFAULT 'channel'"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "conversations", "response_policy", "TEXT NOT NULL DEFAULT 'always'"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "conversations", "response_prefix", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "conversations", "record_context", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "conversations", "guild_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "conversations", "reply_ids", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "conversations", "reply_index", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "messages", "name", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "messages", "author_id", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "guilds", "general_channel", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "guilds", "default_model", "TEXT NOT NULL DEFAULT ''"); err != nil {
+		return nil, err
+	}
+	if err := addColumn(db, "guilds", "max_conversations", "INTEGER NOT NULL DEFAULT 0"); err != nil {
+		return nil, err
+	}
+
+	// Built-in presets are stored without a guild, refresh them in case they changed since the last release
+	for name, prompt := range builtinPresets {
+		if _, err := db.Exec(`INSERT OR REPLACE INTO presets(guild_id, name, prompt) VALUES ('', ?, ?)`, name, prompt); err != nil {
+			return nil, err
+		}
+	}
+
 	return db, nil
 }
 
+// addColumn adds column to table with the given definition, unless the table already has it
+func addColumn(db *sql.DB, table string, column string, definition string) error {
+	rows, err := db.Query(fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var (
+			cid        int
+			name       string
+			colType    string
+			notNull    int
+			defaultVal sql.NullString
+			primaryKey int
+		)
+		if err := rows.Scan(&cid, &name, &colType, &notNull, &defaultVal, &primaryKey); err != nil {
+			return err
+		}
+		if name == column {
+			return nil
+		}
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	_, err = db.Exec(fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column, definition))
+	return err
+}
+
 // createConvoMessageUsage initializes a new conversation. It creates the db entry for the conversation, the initial message (the system message), and the usage
 func createConvoMessageUsage(b Bot, conv conversation) (err error) {
 	tx, err := b.db.Begin()
@@ -56,8 +169,8 @@ func createConvoMessageUsage(b Bot, conv conversation) (err error) {
 
 	// Insert into conversations table
 	if _, err := tx.Exec(
-		"INSERT INTO conversations(channel_id, name, model, temperature, total_choices, system_prompt) VALUES(?, ?, ?, ?, ?, ?)",
-		conv.ChannelID, conv.Name, conv.Model, conv.Temperature, conv.TotalChoices, conv.SystemPrompt,
+		"INSERT INTO conversations(channel_id, guild_id, kind, name, model, temperature, total_choices, system_prompt, base_url, stream, topic_prompt, response_policy, response_prefix, record_context) VALUES(?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)",
+		conv.ChannelID, conv.GuildID, conv.Kind, conv.Name, conv.Model, conv.Temperature, conv.TotalChoices, conv.SystemPrompt, conv.BaseURL, conv.Stream, conv.TopicPrompt, conv.Policy, conv.Prefix, conv.RecordContext,
 	); err != nil {
 		tx.Rollback()
 		return err
@@ -66,8 +179,8 @@ func createConvoMessageUsage(b Bot, conv conversation) (err error) {
 	// Insert into messages table
 	for _, msg := range conv.Messages {
 		_, err = tx.Exec(
-			"INSERT INTO messages(idx, channel_id, role, content) VALUES(?, ?, ?, ?)",
-			msg.Index, conv.ChannelID, msg.Role, msg.Content,
+			"INSERT INTO messages(idx, channel_id, role, content, name, author_id) VALUES(?, ?, ?, ?, ?, ?)",
+			msg.Index, conv.ChannelID, msg.Role, msg.Content, msg.Name, msg.AuthorID,
 		)
 		if err != nil {
 			tx.Rollback()
@@ -102,6 +215,12 @@ func deleteConvoMessageUsage(b Bot, channelID string) (err error) {
 		return err
 	}
 
+	// Delete summaries
+	if _, err := tx.Exec("DELETE FROM summaries WHERE channel_id = ?", channelID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
 	// Delete messages
 	if _, err := tx.Exec("DELETE FROM messages WHERE channel_id = ?", channelID); err != nil {
 		tx.Rollback()
@@ -124,7 +243,7 @@ func deleteConvoMessageUsage(b Bot, channelID string) (err error) {
 }
 
 func selectAllConversations(b Bot) ([]conversation, error) {
-	convoRes, err := b.db.Query(`SELECT * FROM conversations`)
+	convoRes, err := b.db.Query(`SELECT channel_id, guild_id, kind, name, model, temperature, total_choices, system_prompt, base_url, stream, topic_prompt, response_policy, response_prefix, record_context, reply_ids, reply_index FROM conversations`)
 	if err != nil {
 		return nil, err
 	}
@@ -132,17 +251,25 @@ func selectAllConversations(b Bot) ([]conversation, error) {
 	convos := make([]conversation, 0)
 	for convoRes.Next() {
 		convo := conversation{Conversation: &openai.Conversation{}}
-		if err := convoRes.Scan(&convo.ChannelID, &convo.Name, &convo.Model, &convo.Temperature, &convo.TotalChoices, &convo.SystemPrompt); err != nil {
+		var replyIDs string
+		if err := convoRes.Scan(&convo.ChannelID, &convo.GuildID, &convo.Kind, &convo.Name, &convo.Model, &convo.Temperature, &convo.TotalChoices, &convo.SystemPrompt, &convo.BaseURL, &convo.Stream, &convo.TopicPrompt, &convo.Policy, &convo.Prefix, &convo.RecordContext, &replyIDs, &convo.ReplyIndex); err != nil {
 			return nil, err
 		}
+		if replyIDs != "" {
+			convo.ReplyIDs = strings.Split(replyIDs, ",")
+		}
 
-		convo.Init(b.openAIClient)
+		convo.Init(b.provider)
 
 		msgs, err := selectMessagesByChannelID(b, convo.ChannelID)
 		if err != nil {
 			return nil, err
 		}
 		convo.Messages = msgs
+		// Reply IDs saved without an index belong to the last message, if it is still a reply
+		if n := len(msgs); convo.ReplyIndex == 0 && len(convo.ReplyIDs) > 0 && n > 0 && msgs[n-1].Role == openai.ROLE_ASSISTANT {
+			convo.ReplyIndex = msgs[n-1].Index
+		}
 
 		usage, err := selectUsageByChannelID(b, convo.ChannelID)
 		if err != nil {
@@ -150,6 +277,12 @@ func selectAllConversations(b Bot) ([]conversation, error) {
 		}
 		convo.Usage = usage
 
+		summary, err := selectLatestSummaryByChannelID(b, convo.ChannelID)
+		if err != nil {
+			return nil, err
+		}
+		convo.Summary = summary
+
 		convos = append(convos, convo)
 
 	}
@@ -161,30 +294,143 @@ func selectAllConversations(b Bot) ([]conversation, error) {
 	return convos, nil
 }
 
+// updateConversationSettings stores a conversation's model, temperature and number of choices
+func updateConversationSettings(b Bot, c *conversation) error {
+	settings := c.Settings()
+	if _, err := b.db.Exec(`UPDATE conversations SET model = ?, temperature = ?, total_choices = ? WHERE channel_id = ?`, settings.Model, settings.Temperature, settings.TotalChoices, c.ChannelID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// updateSystemPrompt stores a conversation's new system prompt along with its first message, which holds the prompt
+func updateSystemPrompt(b Bot, channelID string, prompt string) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE conversations SET system_prompt = ? WHERE channel_id = ?`, prompt, channelID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if _, err := tx.Exec(`UPDATE messages SET content = ? WHERE channel_id = ? AND idx = 1`, prompt, channelID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func updateConversationGuild(b Bot, channelID string, guildID string) error {
+	if _, err := b.db.Exec(`UPDATE conversations SET guild_id = ? WHERE channel_id = ?`, guildID, channelID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func updateTopicPrompt(b Bot, channelID string, enabled bool) error {
+	if _, err := b.db.Exec(`UPDATE conversations SET topic_prompt = ? WHERE channel_id = ?`, enabled, channelID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func updateStream(b Bot, channelID string, enabled bool) error {
+	if _, err := b.db.Exec(`UPDATE conversations SET stream = ? WHERE channel_id = ?`, enabled, channelID); err != nil {
+		return err
+	}
+	return nil
+}
+
+func updateResponsePolicy(b Bot, channelID string, p policySettings) error {
+	if _, err := b.db.Exec(`UPDATE conversations SET response_policy = ?, response_prefix = ?, record_context = ? WHERE channel_id = ?`, p.Policy, p.Prefix, p.RecordContext, channelID); err != nil {
+		return err
+	}
+	return nil
+}
+
+// updateLatestReply stores the index of the conversation's latest reply and its Discord messages, as a comma separated
+// list
+func updateLatestReply(b Bot, c *conversation) error {
+	index, ids := c.latestReply()
+	if _, err := b.db.Exec(`UPDATE conversations SET reply_ids = ?, reply_index = ? WHERE channel_id = ?`, strings.Join(ids, ","), index, c.ChannelID); err != nil {
+		return err
+	}
+	return nil
+}
+
 func insertMessage(b Bot, channelID string, m openai.Message) error {
-	if _, err := b.db.Exec(`INSERT INTO messages(idx, channel_id, role, content) VALUES (?, ?, ?, ?)`, m.Index, channelID, m.Role, m.Content); err != nil {
+	if _, err := b.db.Exec(`INSERT INTO messages(idx, channel_id, role, content, name, author_id) VALUES (?, ?, ?, ?, ?, ?)`, m.Index, channelID, m.Role, m.Content, m.Name, m.AuthorID); err != nil {
 		return err
 	}
 	return nil
 }
 
+// insertExchange stores a user message, the response to it and the updated usage in a single transaction
+func insertExchange(b Bot, channelID string, userMsg openai.Message, botMsg openai.Message, u openai.Usage) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	for _, m := range []openai.Message{userMsg, botMsg} {
+		if _, err := tx.Exec(`INSERT INTO messages(idx, channel_id, role, content, name, author_id) VALUES (?, ?, ?, ?, ?, ?)`, m.Index, channelID, m.Role, m.Content, m.Name, m.AuthorID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+
+	if _, err := tx.Exec(`UPDATE usages
+    SET completion_tokens = ?, prompt_tokens = ?, total_tokens = ?
+    WHERE channel_id = ?`, u.CompletionTokens, u.PromptTokens, u.TotalTokens, channelID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// replaceReply swaps a regenerated reply in for the message it replaced, the one with the same index, and stores the
+// updated usage in a single transaction
+func replaceReply(b Bot, channelID string, m openai.Message, u openai.Usage) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM messages WHERE channel_id = ? AND idx = ?`, channelID, m.Index); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO messages(idx, channel_id, role, content, name, author_id) VALUES (?, ?, ?, ?, ?, ?)`, m.Index, channelID, m.Role, m.Content, m.Name, m.AuthorID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE usages
+    SET completion_tokens = ?, prompt_tokens = ?, total_tokens = ?
+    WHERE channel_id = ?`, u.CompletionTokens, u.PromptTokens, u.TotalTokens, channelID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
+
 func selectMessagesByChannelID(b Bot, channelID string) ([]openai.Message, error) {
-	msgRes, err := b.db.Query(`SELECT * FROM messages WHERE channel_id = ? ORDER BY idx ASC`, channelID)
+	msgRes, err := b.db.Query(`SELECT idx, role, content, name, author_id FROM messages WHERE channel_id = ? ORDER BY idx ASC`, channelID)
 	if err != nil {
 		return nil, err
 	}
 
 	msgs := make([]openai.Message, 0)
 	for msgRes.Next() {
-		msg := struct {
-			ChannelID string
-			openai.Message
-		}{}
-
-		if err := msgRes.Scan(&msg.Index, &msg.ChannelID, &msg.Role, &msg.Content); err != nil {
+		var msg openai.Message
+		if err := msgRes.Scan(&msg.Index, &msg.Role, &msg.Content, &msg.Name, &msg.AuthorID); err != nil {
 			return nil, err
 		}
-		msgs = append(msgs, msg.Message)
+		msgs = append(msgs, msg)
 	}
 	if err := msgRes.Err(); err != nil {
 		return nil, err
@@ -213,3 +459,161 @@ func selectUsageByChannelID(b Bot, channelID string) (openai.Usage, error) {
 
 	return usage.Usage, nil
 }
+
+// insertSummary stores a conversation's new summary. Earlier summaries are kept, each recording the messages it covers.
+func insertSummary(b Bot, channelID string, summary openai.Summary) error {
+	if _, err := b.db.Exec(`INSERT INTO summaries(channel_id, start_idx, end_idx, content) VALUES (?, ?, ?, ?)`, channelID, summary.StartIndex, summary.EndIndex, summary.Content); err != nil {
+		return err
+	}
+	return nil
+}
+
+// selectLatestSummaryByChannelID returns the summary covering the most messages, or nil if the conversation has none
+func selectLatestSummaryByChannelID(b Bot, channelID string) (*openai.Summary, error) {
+	summary := openai.Summary{}
+	err := b.db.QueryRow(`SELECT start_idx, end_idx, content FROM summaries WHERE channel_id = ? ORDER BY end_idx DESC LIMIT 1`, channelID).Scan(&summary.StartIndex, &summary.EndIndex, &summary.Content)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &summary, nil
+}
+
+// selectPreset returns the guild's preset with the given name, falling back to the built-in preset of that name
+func selectPreset(b Bot, guildID string, name string) (preset, bool, error) {
+	p := preset{}
+	err := b.db.QueryRow(`SELECT guild_id, name, prompt FROM presets WHERE guild_id IN (?, '') AND name = ? ORDER BY guild_id DESC LIMIT 1`, guildID, name).Scan(&p.GuildID, &p.Name, &p.Prompt)
+	if errors.Is(err, sql.ErrNoRows) {
+		return preset{}, false, nil
+	}
+	if err != nil {
+		return preset{}, false, err
+	}
+	return p, true, nil
+}
+
+// selectPresets returns the presets available in a guild ordered by name, with the guild's own presets taking the
+// place of built-in presets of the same name
+func selectPresets(b Bot, guildID string) ([]preset, error) {
+	rows, err := b.db.Query(`SELECT guild_id, name, prompt FROM presets WHERE guild_id IN (?, '') ORDER BY name ASC, guild_id DESC`, guildID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	presets := make([]preset, 0)
+	for rows.Next() {
+		p := preset{}
+		if err := rows.Scan(&p.GuildID, &p.Name, &p.Prompt); err != nil {
+			return nil, err
+		}
+		if len(presets) > 0 && presets[len(presets)-1].Name == p.Name {
+			continue
+		}
+		presets = append(presets, p)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	return presets, nil
+}
+
+func upsertPreset(b Bot, p preset) error {
+	if _, err := b.db.Exec(`INSERT OR REPLACE INTO presets(guild_id, name, prompt) VALUES (?, ?, ?)`, p.GuildID, p.Name, p.Prompt); err != nil {
+		return err
+	}
+	return nil
+}
+
+// deletePreset deletes one of the guild's presets, reporting whether it existed
+func deletePreset(b Bot, guildID string, name string) (bool, error) {
+	res, err := b.db.Exec(`DELETE FROM presets WHERE guild_id = ? AND name = ?`, guildID, name)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+// selectGuildDefaultPreset returns the name of the guild's default preset, empty if it has none
+func selectGuildDefaultPreset(b Bot, guildID string) (string, error) {
+	var name string
+	err := b.db.QueryRow(`SELECT default_preset FROM guilds WHERE guild_id = ?`, guildID).Scan(&name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return "", nil
+	}
+	return name, err
+}
+
+func upsertGuildDefaultPreset(b Bot, guildID string, name string) error {
+	if _, err := b.db.Exec(`INSERT INTO guilds(guild_id, default_preset) VALUES (?, ?)
+    ON CONFLICT (guild_id) DO UPDATE SET default_preset = excluded.default_preset`, guildID, name); err != nil {
+		return err
+	}
+	return nil
+}
+
+func selectDMCount(b Bot, userID string, day string) (int, error) {
+	var count int
+	err := b.db.QueryRow(`SELECT count FROM dm_quotas WHERE user_id = ? AND day = ?`, userID, day).Scan(&count)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, nil
+	}
+	return count, err
+}
+
+func incrementDMCount(b Bot, userID string, day string) error {
+	if _, err := b.db.Exec(`INSERT INTO dm_quotas(user_id, day, count) VALUES (?, ?, 1)
+    ON CONFLICT (user_id, day) DO UPDATE SET count = count + 1`, userID, day); err != nil {
+		return err
+	}
+	return nil
+}
+
+// selectGuild returns the guild's settings, which are all left at their defaults if the guild has none stored
+func selectGuild(b Bot, guildID string) (guildSettings, error) {
+	g := guildSettings{GuildID: guildID}
+	err := b.db.QueryRow(
+		`SELECT default_preset, general_channel, default_model, max_conversations FROM guilds WHERE guild_id = ?`, guildID,
+	).Scan(&g.DefaultPreset, &g.GeneralChannel, &g.DefaultModel, &g.MaxConversations)
+	if errors.Is(err, sql.ErrNoRows) {
+		return g, nil
+	}
+	return g, err
+}
+
+func upsertGuild(b Bot, g guildSettings) error {
+	if _, err := b.db.Exec(`INSERT INTO guilds(guild_id, default_preset, general_channel, default_model, max_conversations) VALUES (?, ?, ?, ?, ?)
+    ON CONFLICT (guild_id) DO UPDATE SET default_preset = excluded.default_preset, general_channel = excluded.general_channel,
+        default_model = excluded.default_model, max_conversations = excluded.max_conversations`,
+		g.GuildID, g.DefaultPreset, g.GeneralChannel, g.DefaultModel, g.MaxConversations); err != nil {
+		return err
+	}
+	return nil
+}
+
+// deleteGuild removes the guild's settings and presets, for when the bot leaves it
+func deleteGuild(b Bot, guildID string) error {
+	tx, err := b.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM presets WHERE guild_id = ?`, guildID); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if _, err := tx.Exec(`DELETE FROM guilds WHERE guild_id = ?`, guildID); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	return tx.Commit()
+}
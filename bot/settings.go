@@ -0,0 +1,242 @@
+package bot
+
+import (
+	"context"
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/mdesson/chatcord/openai"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// manageChannels is the permission needed to change a conversation's settings
+var manageChannels int64 = discordgo.PermissionManageChannels
+
+// modelCache remembers the models the provider offers, so autocompleting doesn't list them on every keystroke
+type modelCache struct {
+	mu        sync.Mutex
+	models    []openai.Model
+	fetchedAt time.Time
+}
+
+const modelCacheTTL = 10 * time.Minute
+
+// get returns the provider's models, listing them again once the cache is stale
+func (mc *modelCache) get(b *Bot) ([]openai.Model, error) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if mc.models != nil && time.Since(mc.fetchedAt) < modelCacheTTL {
+		return mc.models, nil
+	}
+
+	// Autocomplete has to respond within 3 seconds
+	ctx, cancel := context.WithTimeout(b.ctx, 2*time.Second)
+	defer cancel()
+
+	models, err := b.provider.ListModels(ctx)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(models, func(i, j int) bool { return models[i] < models[j] })
+
+	mc.models = models
+	mc.fetchedAt = time.Now()
+	return models, nil
+}
+
+// modelCommand shows or changes the model a conversation uses
+func modelCommand() command {
+	return command{
+		definition: &discordgo.ApplicationCommand{
+			Name:                     "model",
+			Description:              "Show or change the model this channel's conversation uses",
+			DefaultMemberPermissions: &manageChannels,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:         discordgo.ApplicationCommandOptionString,
+					Name:         "name",
+					Description:  "Model to switch to",
+					Autocomplete: true,
+				},
+			},
+		},
+		handler: func(b *Bot, i *discordgo.InteractionCreate, opts commandOptions) error {
+			c, ok := b.conversations.get(i.ChannelID)
+			if !ok {
+				return userError("This channel isn't a conversation.")
+			}
+
+			name, ok := opts.String("name")
+			if !ok {
+				respondEphemeral(b, i, fmt.Sprintf("This conversation uses `%s`.", c.Settings().Model))
+				return nil
+			}
+			model := openai.Model(strings.TrimSpace(name))
+
+			if err := checkModel(b, model); err != nil {
+				return err
+			}
+
+			c.SetModel(model)
+			if err := updateConversationSettings(*b, c); err != nil {
+				return err
+			}
+
+			respond(b, i, fmt.Sprintf("This conversation now uses `%s`.", model))
+			return nil
+		},
+		autocomplete: func(b *Bot, i *discordgo.InteractionCreate, focused string, opts commandOptions) []*discordgo.ApplicationCommandOptionChoice {
+			models, err := b.models.get(b)
+			if err != nil {
+				b.l.Warn(err.Error(), "command", "model", "channel_id", i.ChannelID)
+				return nil
+			}
+
+			typed, _ := opts.String(focused)
+			return modelChoices(models, typed)
+		},
+	}
+}
+
+// modelChoices suggests the models whose name contains what was typed
+func modelChoices(models []openai.Model, typed string) []*discordgo.ApplicationCommandOptionChoice {
+	var choices []*discordgo.ApplicationCommandOptionChoice
+	for _, m := range models {
+		if strings.Contains(string(m), strings.ToLower(typed)) {
+			choices = append(choices, &discordgo.ApplicationCommandOptionChoice{Name: string(m), Value: string(m)})
+		}
+	}
+	return choices
+}
+
+// checkModel makes sure the model is one the provider offers
+func checkModel(b *Bot, model openai.Model) error {
+	// Servers that can't list their models are trusted to know the name
+	models, err := b.models.get(b)
+	if err != nil {
+		b.l.Warn(err.Error(), "model", model)
+		return nil
+	}
+	if !containsModel(models, model) {
+		return userError("`%s` isn't a model available to the bot.", model)
+	}
+	return nil
+}
+
+func containsModel(models []openai.Model, model openai.Model) bool {
+	for _, m := range models {
+		if m == model {
+			return true
+		}
+	}
+	return false
+}
+
+// temperatureCommand shows or changes a conversation's sampling temperature
+func temperatureCommand() command {
+	minTemperature := 0.0
+	return command{
+		definition: &discordgo.ApplicationCommand{
+			Name:                     "temperature",
+			Description:              "Show or change how random this channel's replies are",
+			DefaultMemberPermissions: &manageChannels,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionNumber,
+					Name:        "value",
+					Description: "Between 0 and 2, higher is more random",
+					MinValue:    &minTemperature,
+					MaxValue:    2,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionBoolean,
+					Name:        "reset",
+					Description: "Go back to the model's default temperature",
+				},
+			},
+		},
+		handler: func(b *Bot, i *discordgo.InteractionCreate, opts commandOptions) error {
+			c, ok := b.conversations.get(i.ChannelID)
+			if !ok {
+				return userError("This channel isn't a conversation.")
+			}
+
+			value, hasValue := opts.Float("value")
+			reset, _ := opts.Bool("reset")
+
+			switch {
+			case reset:
+				c.SetTemperature(nil)
+			case hasValue:
+				if value < 0 || value > 2 {
+					return userError("The temperature must be between 0 and 2.")
+				}
+				c.SetTemperature(&value)
+			default:
+				respondEphemeral(b, i, fmt.Sprintf("This conversation's temperature is %s.", formatTemperature(c.Settings().Temperature)))
+				return nil
+			}
+
+			if err := updateConversationSettings(*b, c); err != nil {
+				return err
+			}
+
+			respond(b, i, fmt.Sprintf("This conversation's temperature is now %s.", formatTemperature(c.Settings().Temperature)))
+			return nil
+		},
+	}
+}
+
+func formatTemperature(temperature *float64) string {
+	if temperature == nil {
+		return "the model's default"
+	}
+	return fmt.Sprintf("`%.2g`", *temperature)
+}
+
+// choicesCommand shows or changes how many completions a conversation requests for each message
+func choicesCommand() command {
+	minChoices := 1.0
+	return command{
+		definition: &discordgo.ApplicationCommand{
+			Name:                     "choices",
+			Description:              "Show or change how many completions are requested for each message",
+			DefaultMemberPermissions: &manageChannels,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionInteger,
+					Name:        "count",
+					Description: "Completions per message, only the first is posted",
+					MinValue:    &minChoices,
+					MaxValue:    10,
+				},
+			},
+		},
+		handler: func(b *Bot, i *discordgo.InteractionCreate, opts commandOptions) error {
+			c, ok := b.conversations.get(i.ChannelID)
+			if !ok {
+				return userError("This channel isn't a conversation.")
+			}
+
+			count, ok := opts.Int("count")
+			if !ok {
+				respondEphemeral(b, i, fmt.Sprintf("This conversation requests %d completion(s) per message.", c.Settings().TotalChoices))
+				return nil
+			}
+			if count < 1 || count > 10 {
+				return userError("The number of choices must be between 1 and 10.")
+			}
+
+			c.SetTotalChoices(int(count))
+			if err := updateConversationSettings(*b, c); err != nil {
+				return err
+			}
+
+			respond(b, i, fmt.Sprintf("This conversation now requests %d completion(s) per message.", count))
+			return nil
+		},
+	}
+}
@@ -0,0 +1,175 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"strings"
+)
+
+// defaultSystemPrompt is the system prompt new conversations start with
+const defaultSystemPrompt = "You are a helpful assistant. If you need to use formatting, send it with discord-flavoured markdown."
+
+// systemCommand shows, replaces or resets a conversation's system prompt
+func systemCommand() command {
+	return command{
+		definition: &discordgo.ApplicationCommand{
+			Name:                     "system",
+			Description:              "Manage this channel's system prompt",
+			DefaultMemberPermissions: &manageChannels,
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "show",
+					Description: "Show the system prompt",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "set",
+					Description: "Replace the system prompt, leave the prompt out to write a long one in a form",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionString,
+							Name:        "prompt",
+							Description: "The new system prompt",
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "reset",
+					Description: "Go back to the server's default system prompt",
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "topic",
+					Description: "Keep the system prompt in sync with the channel topic",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionBoolean,
+							Name:        "enabled",
+							Description: "Whether the channel topic is the system prompt",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+		handler: func(b *Bot, i *discordgo.InteractionCreate, opts commandOptions) error {
+			c, ok := b.conversations.get(i.ChannelID)
+			if !ok {
+				return userError("This channel isn't a conversation.")
+			}
+
+			// The topic would overwrite any other prompt the next time it changes
+			if c.followsTopic() && (opts.subcommand == "set" || opts.subcommand == "reset") {
+				return userError("This channel's system prompt comes from its topic. Turn that off with `/system topic enabled:False` first.")
+			}
+
+			switch opts.subcommand {
+			case "show":
+				heading := "This channel's system prompt is:"
+				if c.followsTopic() {
+					heading = "This channel's system prompt comes from its topic:"
+				}
+				respondEphemeral(b, i, formatPrompt(heading, c.Settings().SystemPrompt))
+				return nil
+			case "topic":
+				enabled, _ := opts.Bool("enabled")
+				if err := updateTopicPrompt(*b, c.ChannelID, enabled); err != nil {
+					return err
+				}
+				c.setTopicPrompt(enabled)
+				if !enabled {
+					respondEphemeral(b, i, "This channel's system prompt no longer follows its topic.")
+					return nil
+				}
+
+				channel, err := b.discordClient.Session.Channel(c.ChannelID)
+				if err != nil {
+					return err
+				}
+				if err := syncTopicPrompt(b, c, channel); err != nil {
+					return err
+				}
+				respondEphemeral(b, i, formatPrompt("This channel's system prompt now follows its topic:", c.Settings().SystemPrompt))
+				return nil
+			case "set":
+				prompt, ok := opts.String("prompt")
+				if !ok {
+					return openModal(b, i, "system", "System prompt", "Prompt", c.Settings().SystemPrompt)
+				}
+				return setSystemPrompt(b, i, c, prompt)
+			case "reset":
+				return setSystemPrompt(b, i, c, guildDefaultPrompt(b, i.GuildID))
+			default:
+				return fmt.Errorf("unknown subcommand %q", opts.subcommand)
+			}
+		},
+		modal: func(b *Bot, i *discordgo.InteractionCreate, data discordgo.ModalSubmitInteractionData) error {
+			c, ok := b.conversations.get(i.ChannelID)
+			if !ok {
+				return userError("This channel isn't a conversation.")
+			}
+			return setSystemPrompt(b, i, c, modalText(data))
+		},
+	}
+}
+
+// setSystemPrompt replaces a conversation's system prompt in memory and in the db, then confirms it to the member
+func setSystemPrompt(b *Bot, i *discordgo.InteractionCreate, c *conversation, prompt string) error {
+	if prompt == "" {
+		return userError("The system prompt can't be empty.")
+	}
+
+	if err := updateSystemPrompt(*b, c.ChannelID, prompt); err != nil {
+		return err
+	}
+	c.UpdatePrompt(prompt)
+
+	respondEphemeral(b, i, formatPrompt("This channel's system prompt is now:", prompt))
+	return nil
+}
+
+// Marks the part of a channel topic to use as the system prompt, when the topic holds more than the prompt
+const (
+	topicPromptStart = "[prompt]"
+	topicPromptEnd   = "[/prompt]"
+)
+
+// topicPrompt returns the system prompt held by a channel topic: the text between [prompt] and [/prompt] if the topic
+// has them, otherwise the whole topic
+func topicPrompt(topic string) string {
+	if _, after, ok := strings.Cut(topic, topicPromptStart); ok {
+		topic, _, _ = strings.Cut(after, topicPromptEnd)
+	}
+	return strings.TrimSpace(topic)
+}
+
+// syncTopicPrompt makes the channel's topic the conversation's system prompt, or the guild's default prompt when the
+// topic is empty
+func syncTopicPrompt(b *Bot, c *conversation, channel *discordgo.Channel) error {
+	prompt := topicPrompt(channel.Topic)
+	if prompt == "" {
+		prompt = guildDefaultPrompt(b, channel.GuildID)
+	}
+	if prompt == c.Settings().SystemPrompt {
+		return nil
+	}
+
+	if err := updateSystemPrompt(*b, c.ChannelID, prompt); err != nil {
+		return err
+	}
+	c.UpdatePrompt(prompt)
+
+	b.l.Info("updated system prompt from topic", "channel_id", c.ChannelID)
+	return nil
+}
+
+// formatPrompt quotes a prompt below a heading, shortening it to fit in a single message
+func formatPrompt(heading string, prompt string) string {
+	const maxLen = 1800
+	if runes := []rune(prompt); len(runes) > maxLen {
+		prompt = string(runes[:maxLen]) + "…"
+	}
+	return fmt.Sprintf("%s\n```\n%s\n```", heading, prompt)
+}
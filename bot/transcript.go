@@ -0,0 +1,76 @@
+package bot
+
+import (
+	"fmt"
+	"github.com/bwmarrin/discordgo"
+	"github.com/mdesson/chatcord/openai"
+	"strings"
+)
+
+// userMessage turns a discord message into a user message for the conversation, naming its author so the model can
+// tell the members of a shared channel apart
+func userMessage(message *discordgo.Message, content string) openai.Message {
+	return openai.Message{
+		Role:     openai.ROLE_USER,
+		Content:  content,
+		Name:     authorName(message),
+		AuthorID: message.Author.ID,
+	}
+}
+
+// authorName returns the name the model knows the message's author by: their nickname in the guild if they have one
+// that fits the API's rules, otherwise their username
+func authorName(message *discordgo.Message) string {
+	if message.Member != nil {
+		if name := openai.SanitizeName(message.Member.Nick); name != "" {
+			return name
+		}
+	}
+	if name := openai.SanitizeName(message.Author.Username); name != "" {
+		return name
+	}
+	return "user_" + message.Author.ID
+}
+
+// renderTranscript writes out the messages as plain text, one message per paragraph headed by who sent it
+func renderTranscript(messages []openai.Message) string {
+	var sb strings.Builder
+	for _, m := range messages {
+		speaker := string(m.Role)
+		if m.Name != "" {
+			speaker = m.Name
+		}
+		sb.WriteString(fmt.Sprintf("[%s]\n%s\n\n", speaker, m.Content))
+	}
+	return sb.String()
+}
+
+// transcriptCommand sends the member a copy of the conversation's history, showing who said what
+func transcriptCommand() command {
+	return command{
+		definition: &discordgo.ApplicationCommand{
+			Name:        "transcript",
+			Description: "Get a transcript of this channel's conversation, showing who said what",
+		},
+		handler: func(b *Bot, i *discordgo.InteractionCreate, opts commandOptions) error {
+			c, ok := b.conversations.get(i.ChannelID)
+			if !ok {
+				return userError("This channel isn't a conversation.")
+			}
+
+			// Copy the history so the conversation isn't held up while it is written out
+			messages := c.History()
+
+			sendResponse(b, i, &discordgo.InteractionResponseData{
+				Content: fmt.Sprintf("Transcript of the %d messages in this conversation.", len(messages)),
+				Flags:   discordgo.MessageFlagsEphemeral,
+				Files: []*discordgo.File{{
+					Name:        fmt.Sprintf("transcript-%s.txt", c.ChannelID),
+					ContentType: "text/plain",
+					Reader:      strings.NewReader(renderTranscript(messages)),
+				}},
+			})
+			return nil
+		},
+	}
+}
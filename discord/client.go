@@ -3,7 +3,9 @@ package discord
 import (
 	"fmt"
 	"github.com/bwmarrin/discordgo"
+	"github.com/mdesson/chatcord/util"
 	"os"
+	"strings"
 	"time"
 )
 
@@ -11,8 +13,11 @@ type Client struct {
 	apiToken          string
 	Session           *discordgo.Session
 	streamBatchWaitMs int64
-	GuildID           string
-	GeneralChannel    string
+	// The channel the bot announces itself in is looked up in each guild by ID, then by name, then falls back to the
+	// guild's system channel if GeneralChannelAuto is set. Announcements are skipped in guilds where none is found.
+	GeneralChannel     string // ID of the channel, in the guild it belongs to
+	GeneralChannelName string // Name of the channel, in any guild
+	GeneralChannelAuto bool   // Whether to fall back to the guild's system channel
 }
 
 func NewClient(streamBatchWaitMs int64) (*Client, error) {
@@ -22,24 +27,19 @@ func NewClient(streamBatchWaitMs int64) (*Client, error) {
 		return nil, fmt.Errorf("DISCORD_API_TOKEN environment variable not set")
 	}
 
-	// TODO: Find general general channel on start, add env var to optionally pass name or id for it
-	generalChannel := os.Getenv("GENERAL_CHANNEL_ID")
-	if generalChannel == "" {
-		return nil, fmt.Errorf("GENERAL_CHANNEL_ID environment variable not set")
-	}
-
 	session, err := discordgo.New("Bot " + apiToken)
 	if err != nil {
 		return nil, err
 	}
 
-	channel, err := session.Channel(generalChannel)
-	if err != nil {
-		return nil, err
-	}
-	guildID := channel.GuildID
-
-	return &Client{Session: session, apiToken: apiToken, streamBatchWaitMs: streamBatchWaitMs, GuildID: guildID, GeneralChannel: generalChannel}, nil
+	return &Client{
+		Session:            session,
+		apiToken:           apiToken,
+		streamBatchWaitMs:  streamBatchWaitMs,
+		GeneralChannel:     os.Getenv("GENERAL_CHANNEL_ID"),
+		GeneralChannelName: os.Getenv("GENERAL_CHANNEL_NAME"),
+		GeneralChannelAuto: util.EnvBool("GENERAL_CHANNEL_AUTO", true),
+	}, nil
 }
 
 func (c *Client) SendMessage(message string, channelID string) error {
@@ -52,63 +52,132 @@ func (c *Client) SendMessage(message string, channelID string) error {
 	return err
 }
 
-func (c *Client) StreamMessage(chunks chan string, channelID string) error {
+// SendReply sends text to the channel as a reply, split over as many messages as Discord's 2000 character limit
+// requires, with the components attached to its last message. The messages of a previous version of the reply are
+// rewritten in place if given. It returns the IDs of the reply's messages.
+func (c *Client) SendReply(text string, channelID string, previous []string, components []discordgo.MessageComponent) ([]string, error) {
+	w := &replyWriter{client: c, channelID: channelID, previous: previous}
+	for _, part := range util.ChunkText(text) {
+		if err := w.next(part); err != nil {
+			return w.sent, err
+		}
+	}
+	return w.finish(components)
+}
+
+// StreamMessage sends the text read from chunks to the channel as a reply as it arrives, editing the message in batches
+// and starting a new one whenever it would go over Discord's 2000 character limit. The messages of a previous version of
+// the reply are rewritten in place if given, and the components are attached to the last message once the reply is
+// complete. It returns the IDs of the reply's messages once chunks is closed.
+func (c *Client) StreamMessage(chunks chan string, channelID string, previous []string, components []discordgo.MessageComponent) ([]string, error) {
 	// set typing
 	if err := c.Session.ChannelTyping(channelID); err != nil {
-		return err
+		return nil, err
 	}
-	defer func(session *discordgo.Session, channelID string, options ...discordgo.RequestOption) {
-		_ = session.ChannelTyping(channelID)
-	}(c.Session, channelID)
-
-	// grab the first non-empty string off the channel to create the initial message
-	msgText := ""
-	for msg := range chunks {
-		if msg != "" {
-			msgText = msg
-			break
+
+	w := &replyWriter{client: c, channelID: channelID, previous: previous}
+	buff := ""
+
+	flush := func() error {
+		// Discord rejects blank messages, so wait for some text before sending the first one
+		if buff == "" || (len(w.sent) == 0 && strings.TrimSpace(buff) == "") {
+			return nil
 		}
-	}
 
-	msg, err := c.Session.ChannelMessageSend(channelID, msgText)
-	if err != nil {
-		return err
+		if len(w.sent) > 0 && len(w.text)+len(buff) <= 2000 {
+			err := w.extend(buff)
+			buff = ""
+			return err
+		}
+
+		parts := util.ChunkText(buff)
+		buff = ""
+		for _, part := range parts {
+			if err := w.next(part); err != nil {
+				return err
+			}
+		}
+		return nil
 	}
 
 	ticker := time.NewTicker(time.Duration(c.streamBatchWaitMs) * time.Millisecond)
-	buff := ""
+	defer ticker.Stop()
+
 	for {
 		select {
 		case chunk, ok := <-chunks:
 			if !ok {
-				if buff != "" {
-					if len(msgText)+len(buff) > 2000 {
-						if _, err := c.Session.ChannelMessageSend(channelID, buff); err != nil {
-							return err
-						} else {
-							if _, err := c.Session.ChannelMessageEdit(channelID, msg.ID, msgText+buff); err != nil {
-								return err
-							}
-						}
-					}
+				if err := flush(); err != nil {
+					return w.sent, err
 				}
-				return nil
+				return w.finish(components)
 			}
 			buff += chunk
 		case <-ticker.C:
-			if len(msgText)+len(buff) > 2000 {
-				msgText = buff
-				msg, err = c.Session.ChannelMessageSend(channelID, msgText)
-				if err != nil {
-					return err
-				}
-			} else {
-				msgText += buff
-				if _, err := c.Session.ChannelMessageEdit(channelID, msg.ID, msgText); err != nil {
-					return err
-				}
+			if err := flush(); err != nil {
+				return w.sent, err
 			}
-			buff = ""
 		}
 	}
 }
+
+// replyWriter writes a reply which may span several messages. It reuses the messages of a previous version of the reply
+// before sending new ones, so that a reply can be rewritten in place.
+type replyWriter struct {
+	client    *Client
+	channelID string
+	previous  []string // Messages of the previous version which haven't been reused yet
+	sent      []string // Messages making up the reply so far
+	text      string   // Text of the reply's last message
+}
+
+// next writes text into a new message of the reply
+func (w *replyWriter) next(text string) error {
+	if len(w.previous) > 0 {
+		// Editing also clears the message's components, they are added back to the last message when finishing
+		if _, err := w.client.Session.ChannelMessageEdit(w.channelID, w.previous[0], text); err != nil {
+			return err
+		}
+		w.sent = append(w.sent, w.previous[0])
+		w.previous = w.previous[1:]
+	} else {
+		msg, err := w.client.Session.ChannelMessageSend(w.channelID, text)
+		if err != nil {
+			return err
+		}
+		w.sent = append(w.sent, msg.ID)
+	}
+
+	w.text = text
+	return nil
+}
+
+// extend adds text to the reply's last message
+func (w *replyWriter) extend(text string) error {
+	w.text += text
+	_, err := w.client.Session.ChannelMessageEdit(w.channelID, w.sent[len(w.sent)-1], w.text)
+	return err
+}
+
+// finish deletes the messages of the previous version which weren't reused and attaches the components to the reply's
+// last message. It returns the IDs of the reply's messages.
+func (w *replyWriter) finish(components []discordgo.MessageComponent) ([]string, error) {
+	for _, id := range w.previous {
+		if err := w.client.Session.ChannelMessageDelete(w.channelID, id); err != nil {
+			return w.sent, err
+		}
+	}
+	w.previous = nil
+
+	if len(w.sent) == 0 || len(components) == 0 {
+		return w.sent, nil
+	}
+
+	_, err := w.client.Session.ChannelMessageEditComplex(&discordgo.MessageEdit{
+		ID:         w.sent[len(w.sent)-1],
+		Channel:    w.channelID,
+		Content:    &w.text,
+		Components: components,
+	})
+	return w.sent, err
+}
@@ -1,13 +1,11 @@
 package openai
 
-import (
-	"io"
-)
-
 type Message struct {
-	Index   int    `json:"-"`
-	Role    Role   `json:"role"`
-	Content string `json:"content"`
+	Index    int    `json:"-"`
+	Role     Role   `json:"role"`
+	Content  string `json:"content"`
+	Name     string `json:"name,omitempty"` // Who sent a user message, to tell participants apart. See SanitizeName.
+	AuthorID string `json:"-"`              // ID of whoever sent a user message, kept for the caller's records
 }
 
 type Usage struct {
@@ -17,11 +15,12 @@ type Usage struct {
 }
 
 type ChatRequest struct {
-	Model        Model     `json:"model"`
-	Messages     []Message `json:"messages"`
-	Temperature  *float64  `json:"temperature,omitempty"` // Between 0 and 2
-	Stream       bool      `json:"stream,omitempty"`
-	TotalChoices int       `json:"n,omitempty"`
+	Model         Model          `json:"model"`
+	Messages      []Message      `json:"messages"`
+	Temperature   *float64       `json:"temperature,omitempty"` // Between 0 and 2
+	Stream        bool           `json:"stream,omitempty"`
+	StreamOptions *StreamOptions `json:"stream_options,omitempty"`
+	TotalChoices  int            `json:"n,omitempty"`
 }
 
 type ChatResponse struct {
@@ -30,12 +29,11 @@ type ChatResponse struct {
 		Index        int     `json:"index"`
 		Message      Message `json:"message"`
 	} `json:"choices"`
-	Created  int    `json:"created"`
-	ID       string `json:"id"`
-	Model    Model  `json:"model"`
-	Object   string `json:"object"`
-	Usage    Usage  `json:"usage"`
-	HTTPBody io.ReadCloser
+	Created int    `json:"created"`
+	ID      string `json:"id"`
+	Model   Model  `json:"model"`
+	Object  string `json:"object"`
+	Usage   Usage  `json:"usage"`
 }
 
 type Chunk struct {
@@ -45,7 +43,24 @@ type Chunk struct {
 	Model             Model  `json:"model"`
 	SystemFingerprint string `json:"system_fingerprint"`
 	Choices           []struct {
+		Index        int      `json:"index"`
 		Delta        *Message `json:"delta"`
 		FinishReason *string  `json:"finish_reason,omitempty"`
 	} `json:"choices"`
+	Usage *Usage    `json:"usage,omitempty"` // Only sent in the final chunk, when requested with StreamOptions
+	Error *APIError `json:"error,omitempty"` // Set when the stream fails after it has started
+}
+
+type StreamOptions struct {
+	IncludeUsage bool `json:"include_usage"`
+}
+
+type ModelsResponse struct {
+	Object string `json:"object"`
+	Data   []struct {
+		ID      Model  `json:"id"`
+		Object  string `json:"object"`
+		Created int    `json:"created"`
+		OwnedBy string `json:"owned_by"`
+	} `json:"data"`
 }
@@ -2,59 +2,247 @@ package openai
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"os"
+	"strings"
+	"time"
 )
 
 type Client struct {
-	apiToken string
+	apiToken     string
+	baseURL      string
+	organization string
+	project      string
+	headers      map[string]string
+	retry        RetryPolicy
+	timeout      time.Duration
+	streamUsage  bool
+	onRetry      RetryFunc
+	httpClient   *http.Client
 }
 
-func NewClient() (*Client, error) {
+// NewClient creates a client for the OpenAI API, or any OpenAI-compatible server set in config.BaseURL.
+// The API token is read from OPENAI_TOKEN, which is only required when talking to the official API.
+func NewClient(config ClientConfig) (*Client, error) {
+	baseURL := strings.TrimSuffix(config.BaseURL, "/")
+	if baseURL == "" {
+		baseURL = DEFAULT_BASE_URL
+	}
+
 	// Get API token from environment variable, return error if it's not set
 	apiToken := os.Getenv("OPENAI_TOKEN")
-	if apiToken == "" {
-		return nil, fmt.Errorf("OPENAI_API_TOKEN environment variable not set")
+	if apiToken == "" && baseURL == DEFAULT_BASE_URL {
+		return nil, fmt.Errorf("OPENAI_TOKEN environment variable not set")
 	}
-	return &Client{apiToken: apiToken}, nil
+
+	return &Client{
+		apiToken:     apiToken,
+		baseURL:      baseURL,
+		organization: config.Organization,
+		project:      config.Project,
+		headers:      config.Headers,
+		retry:        config.Retry,
+		timeout:      config.Timeout,
+		streamUsage:  config.StreamUsage,
+		httpClient:   &http.Client{},
+	}, nil
 }
 
-func (c *Client) sendChat(request ChatRequest) (ChatResponse, error) {
-	reqBody, err := json.Marshal(request)
-	if err != nil {
-		return ChatResponse{}, err
+// WithBaseURL returns a copy of the client which sends its requests to baseURL, or the client itself if baseURL is empty
+func (c *Client) WithBaseURL(baseURL string) *Client {
+	if baseURL == "" {
+		return c
 	}
+	client := *c
+	client.baseURL = strings.TrimSuffix(baseURL, "/")
+	return &client
+}
+
+// WithOnRetry returns a copy of the client which calls onRetry before a failed request is retried, e.g. to let the
+// user know
+func (c *Client) WithOnRetry(onRetry RetryFunc) *Client {
+	client := *c
+	client.onRetry = onRetry
+	return &client
+}
 
-	req, err := http.NewRequest("POST", fmt.Sprintf("%s/chat/completions", base_url), bytes.NewBuffer(reqBody))
+// Chat sends a non-streaming chat completion request.
+func (c *Client) Chat(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	request.Stream = false
+	body, err := c.sendChat(ctx, request)
 	if err != nil {
 		return ChatResponse{}, err
 	}
+	defer func(Body io.ReadCloser) {
+		_ = Body.Close()
+	}(body)
 
-	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", "Bearer "+c.apiToken)
+	var chatResponse ChatResponse
+	if err := json.NewDecoder(body).Decode(&chatResponse); err != nil {
+		return ChatResponse{}, err
+	}
+	return chatResponse, nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
+// ChatStream sends a streaming chat completion request and decodes the reply as it arrives.
+// When the client is configured for it, the last chunk of the stream reports the token usage.
+func (c *Client) ChatStream(ctx context.Context, request ChatRequest) (Stream, error) {
+	request.Stream = true
+	if c.streamUsage {
+		request.StreamOptions = &StreamOptions{IncludeUsage: true}
+	}
+	body, err := c.sendChat(ctx, request)
 	if err != nil {
-		return ChatResponse{}, err
+		return nil, err
 	}
+	return newChunkStream(body), nil
+}
+
+// ListModels returns the IDs of all models available to the API token.
+func (c *Client) ListModels(ctx context.Context) ([]Model, error) {
+	ctx, cancel := c.withTimeout(ctx)
+	defer cancel()
 
-	if request.Stream {
-		return ChatResponse{HTTPBody: resp.Body}, nil
+	req, err := c.newRequest(ctx, "GET", "/models", nil)
+	if err != nil {
+		return nil, err
 	}
 
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer func(Body io.ReadCloser) {
+			_ = Body.Close()
+		}(resp.Body)
+		return nil, errorFromResponse(resp)
+	}
 	defer func(Body io.ReadCloser) {
 		_ = Body.Close()
 	}(resp.Body)
 
-	var chatResponse ChatResponse
-	if err := json.NewDecoder(resp.Body).Decode(&chatResponse); err != nil {
-		return ChatResponse{}, err
+	var modelsResponse ModelsResponse
+	if err := json.NewDecoder(resp.Body).Decode(&modelsResponse); err != nil {
+		return nil, err
 	}
-	chatResponse.HTTPBody = resp.Body
 
-	return chatResponse, nil
+	models := make([]Model, 0, len(modelsResponse.Data))
+	for _, m := range modelsResponse.Data {
+		models = append(models, m.ID)
+	}
+	return models, nil
+}
+
+// withTimeout bounds ctx by the client's configured request timeout, if any
+func (c *Client) withTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if c.timeout > 0 {
+		return context.WithTimeout(ctx, c.timeout)
+	}
+	return context.WithCancel(ctx)
+}
+
+// newRequest builds a request against the client's base URL with the authentication and configured headers set
+func (c *Client) newRequest(ctx context.Context, method string, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequestWithContext(ctx, method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+	if c.apiToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.apiToken)
+	}
+	if c.organization != "" {
+		req.Header.Set("OpenAI-Organization", c.organization)
+	}
+	if c.project != "" {
+		req.Header.Set("OpenAI-Project", c.project)
+	}
+	for k, v := range c.headers {
+		req.Header.Set(k, v)
+	}
+
+	return req, nil
+}
+
+// sendChat sends a chat completion request, retrying it as the client's policy allows, and returns the response body.
+// The body must be closed once read.
+func (c *Client) sendChat(ctx context.Context, request ChatRequest) (io.ReadCloser, error) {
+	reqBody, err := json.Marshal(request)
+	if err != nil {
+		return nil, err
+	}
+
+	// The timeout covers retries, and for streams lasts until the body is closed
+	ctx, cancel := c.withTimeout(ctx)
+
+	// Nothing has been generated when a request fails, so it is safe to send it again
+	var resp *http.Response
+	for attempt := 0; ; attempt++ {
+		resp, err = c.doChat(ctx, reqBody)
+		if err == nil || attempt >= c.retry.MaxRetries || !retryable(ctx, err) {
+			break
+		}
+
+		delay, ok := c.retry.delay(attempt+1, err)
+		if !ok {
+			break
+		}
+		if c.onRetry != nil {
+			c.onRetry(attempt+1, delay, err)
+		}
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			cancel()
+			return nil, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+
+	return &cancelOnClose{ReadCloser: resp.Body, cancel: cancel}, nil
+}
+
+// doChat makes a single chat completion request, turning non-2xx responses into errors
+func (c *Client) doChat(ctx context.Context, reqBody []byte) (*http.Response, error) {
+	req, err := c.newRequest(ctx, "POST", "/chat/completions", bytes.NewReader(reqBody))
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		defer func(Body io.ReadCloser) {
+			_ = Body.Close()
+		}(resp.Body)
+		return nil, errorFromResponse(resp)
+	}
+
+	return resp, nil
+}
+
+// cancelOnClose releases a request's context once its body is closed
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+func (b *cancelOnClose) Close() error {
+	defer b.cancel()
+	return b.ReadCloser.Close()
 }
@@ -0,0 +1,45 @@
+package openai
+
+import (
+	"github.com/mdesson/chatcord/util"
+	"time"
+)
+
+// ClientConfig controls which OpenAI-compatible server a Client talks to and how
+type ClientConfig struct {
+	BaseURL      string            // Defaults to DEFAULT_BASE_URL
+	Organization string            // Sent as the OpenAI-Organization header when set
+	Project      string            // Sent as the OpenAI-Project header when set
+	Headers      map[string]string // Extra headers sent with every request
+	Retry        RetryPolicy
+	Timeout      time.Duration // Longest a request may take including retries, 0 for no limit
+	StreamUsage  bool          // Ask for token usage at the end of streams, which not every compatible server supports
+}
+
+// ClientConfigFromEnv reads the client configuration from the environment:
+//
+//	OPENAI_BASE_URL       base URL of the API, e.g. http://localhost:8080/v1
+//	OPENAI_ORGANIZATION   organization ID
+//	OPENAI_PROJECT        project ID
+//	OPENAI_EXTRA_HEADERS  extra headers as "Header-Name=value,Other-Header=value"
+//	OPENAI_MAX_RETRIES    retries after a failed request, 0 to disable
+//	OPENAI_RETRY_DELAY    base backoff between retries, e.g. "1s"
+//	OPENAI_RETRY_MAX_WAIT longest wait before a retry, e.g. "30s"
+//	OPENAI_TIMEOUT        longest a request may take, e.g. "2m", 0 for no limit
+//	OPENAI_STREAM_USAGE   request usage for streams, defaults to true only for the official API
+func ClientConfigFromEnv() ClientConfig {
+	baseURL := util.EnvString("OPENAI_BASE_URL", DEFAULT_BASE_URL)
+	return ClientConfig{
+		BaseURL:      baseURL,
+		Organization: util.EnvString("OPENAI_ORGANIZATION", ""),
+		Project:      util.EnvString("OPENAI_PROJECT", ""),
+		Headers:      util.EnvMap("OPENAI_EXTRA_HEADERS"),
+		Retry: RetryPolicy{
+			MaxRetries: util.EnvInt("OPENAI_MAX_RETRIES", DefaultRetryPolicy.MaxRetries),
+			BaseDelay:  util.EnvDuration("OPENAI_RETRY_DELAY", DefaultRetryPolicy.BaseDelay),
+			MaxDelay:   util.EnvDuration("OPENAI_RETRY_MAX_WAIT", DefaultRetryPolicy.MaxDelay),
+		},
+		Timeout:     util.EnvDuration("OPENAI_TIMEOUT", 2*time.Minute),
+		StreamUsage: util.EnvBool("OPENAI_STREAM_USAGE", baseURL == DEFAULT_BASE_URL),
+	}
+}
@@ -3,7 +3,8 @@ package openai
 type Model string
 type Role string
 
-const base_url = "https://api.openai.com/v1"
+// DEFAULT_BASE_URL is the official OpenAI API, used unless a Client or Conversation overrides it
+const DEFAULT_BASE_URL = "https://api.openai.com/v1"
 
 // Underlying OpenAI Model
 const (
@@ -1,25 +1,40 @@
 package openai
 
 import (
-	"bufio"
-	"encoding/json"
-	"strings"
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"sync"
 )
 
 type Conversation struct {
-	Name         string
+	Name          string
+	Model         Model
+	Messages      []Message
+	Temperature   *float64
+	TotalChoices  int
+	SystemPrompt  string
+	BaseURL       string        // Endpoint the conversation's provider should use instead of its default, when set
+	Truncation    Truncation    // How the history is cut down to fit the model, the full history is kept in Messages
+	Summary       *Summary      // Running summary sent in place of the older turns, nil until there is one
+	Summarization Summarization // When older turns are folded into the summary
+	Usage         Usage         // Usage of the latest request, estimated for streams when the provider doesn't report it
+	provider      Provider
+	busy          sync.Mutex // Held by whatever adds to or removes from Messages, for as long as it takes, requests included
+	mu            sync.Mutex // Guards the fields, only ever held briefly so settings and reads don't wait on requests
+}
+
+// Settings are the conversation's settings as they were when read
+type Settings struct {
 	Model        Model
-	Messages     []Message
 	Temperature  *float64
 	TotalChoices int
 	SystemPrompt string
-	Usage        Usage // Will be zeroed out for streaming conversations, as it is not returned, TODO: Is there an OpenAI endpoint to count tokens in a conversation? Do it myself?
-	client       *Client
-	mu           sync.Mutex
 }
 
-func NewConversation(model Model, systemPrompt string, client *Client) *Conversation {
+// NewConversation creates a conversation seeded with the system prompt which sends its requests to provider
+func NewConversation(model Model, systemPrompt string, provider Provider) *Conversation {
 	return &Conversation{
 		Name:  "temp", // TODO: Conversation name generation
 		Model: model,
@@ -34,103 +49,336 @@ func NewConversation(model Model, systemPrompt string, client *Client) *Conversa
 			PromptTokens:     0,
 			TotalTokens:      0,
 		},
-		client: client,
+		provider: provider,
 	}
 }
 
-func (c *Conversation) Init(client *Client) {
+// Init prepares a conversation loaded from storage to send its requests to provider, before it is used
+func (c *Conversation) Init(provider Provider) {
+	c.busy = sync.Mutex{}
 	c.mu = sync.Mutex{}
-	c.client = client
+	c.provider = provider
+}
+
+// Settings returns the conversation's current settings
+func (c *Conversation) Settings() Settings {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Settings{Model: c.Model, Temperature: c.Temperature, TotalChoices: c.TotalChoices, SystemPrompt: c.SystemPrompt}
 }
 
+// LastIndex returns the index of the message the conversation ends with
+func (c *Conversation) LastIndex() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Messages[len(c.Messages)-1].Index
+}
+
+// LastUsage returns the usage of the conversation's latest request
+func (c *Conversation) LastUsage() Usage {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.Usage
+}
+
+// UpdatePrompt replaces the system prompt, which is always the first message
 func (c *Conversation) UpdatePrompt(prompt string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
 	c.Messages[0].Content = prompt
 	c.SystemPrompt = prompt
 }
 
-// Chat send a message to the OpenAPI backend and get the entire response in a single message.
-func (c *Conversation) Chat(message string) (string, error) {
+// SetModel changes the model used for the rest of the conversation
+func (c *Conversation) SetModel(model Model) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Model = model
+}
+
+// SetTemperature changes the sampling temperature, nil leaves it to the API's default
+func (c *Conversation) SetTemperature(temperature *float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Temperature = temperature
+}
+
+// SetTotalChoices changes how many completions are requested for each message
+func (c *Conversation) SetTotalChoices(totalChoices int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.TotalChoices = totalChoices
+}
+
+// History returns a copy of the conversation's messages, including those left out of the prompt
+func (c *Conversation) History() []Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return append([]Message(nil), c.Messages...)
+}
+
+// PromptTokens counts the tokens the conversation would send to the model after truncation, along with message if it
+// isn't empty
+func (c *Conversation) PromptTokens(message string) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	messages := c.Messages
+	if message != "" {
+		messages = append(messages[:len(messages):len(messages)], Message{Role: ROLE_USER, Content: message})
+	}
+	return CountTokens(c.Model, c.prompt(messages))
+}
+
+// AddMessage adds a message to the history without sending anything, such as context the model should see the next
+// time it is asked. It returns the message as stored. It waits for any request in progress, so the message doesn't
+// land between a question and its reply.
+func (c *Conversation) AddMessage(msg Message) Message {
+	c.busy.Lock()
+	defer c.busy.Unlock()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	msg.Index = len(c.Messages) + 1
+	c.Messages = append(c.Messages, msg)
+	return msg
+}
+
+// userMessage prepares a message from the user to be added to the history. c.mu must be held.
+func (c *Conversation) userMessage(message Message) Message {
+	message.Index = len(c.Messages) + 1
+	message.Role = ROLE_USER
+	return message
+}
+
+// prompt returns the messages to send to the model for the given history, after summarization and truncation. c.mu
+// must be held.
+func (c *Conversation) prompt(messages []Message) []Message {
+	return c.Truncation.Apply(c.Model, c.withSummary(messages))
+}
+
+// request builds the request for a reply to the conversation so far. The prompt is copied, so the request can be sent
+// without holding c.mu.
+func (c *Conversation) request() ChatRequest {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
-	c.Messages = append(c.Messages, Message{Index: len(c.Messages) + 1, Role: ROLE_USER, Content: message})
-	chatResponse, err := c.client.sendChat(ChatRequest{
+	return ChatRequest{
 		Model:        c.Model,
-		Messages:     c.Messages,
+		Messages:     append([]Message(nil), c.prompt(c.Messages)...),
 		Temperature:  c.Temperature,
-		Stream:       false,
 		TotalChoices: c.TotalChoices,
-	})
+	}
+}
+
+// Exchange is what a request added to the conversation, as it was stored. Other messages may have been added since.
+type Exchange struct {
+	User  Message // The user's message, zero when the reply was regenerated
+	Reply Message // The assistant's reply
+	Usage Usage   // Usage of the request
+}
+
+// StreamResult is sent once a stream is done: the exchange if the reply completed, otherwise the error it failed with
+type StreamResult struct {
+	Exchange
+	Err error
+}
+
+// Chat send a message from the user to the OpenAPI backend and get the entire response in a single message.
+func (c *Conversation) Chat(ctx context.Context, message Message) (Exchange, error) {
+	c.busy.Lock()
+	defer c.busy.Unlock()
+
+	user := c.appendUserMessage(message)
+	exchange, err := c.complete(ctx)
 	if err != nil {
-		return "", err
+		c.dropUserMessage()
+		return Exchange{}, err
 	}
+	exchange.User = user
+	return exchange, nil
+}
+
+// ChatStream sends a message from the user to the OpenAI backend and streams back the response as it is generated. The
+// text is sent on the returned string channel, which is closed once the response is complete; the result is sent on
+// the other channel after that, holding the exchange or the error the stream failed with part way. The assistant's
+// message is added to Messages once the stream completes successfully.
+func (c *Conversation) ChatStream(ctx context.Context, message Message) (chan string, chan StreamResult, error) {
+	c.busy.Lock()
+
+	user := c.appendUserMessage(message)
+	return c.stream(ctx, user, c.dropUserMessage)
+}
+
+// appendUserMessage adds a message from the user to the history and returns it as stored. c.busy must be held.
+func (c *Conversation) appendUserMessage(message Message) Message {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	user := c.userMessage(message)
+	c.Messages = append(c.Messages, user)
+	return user
+}
+
+// dropUserMessage removes the unanswered message added by appendUserMessage, so the next attempt doesn't send it twice.
+// c.busy must be held.
+func (c *Conversation) dropUserMessage() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Messages = c.Messages[:len(c.Messages)-1]
+}
+
+// ErrNoReply is returned when regenerating a reply the conversation doesn't end with
+var ErrNoReply = errors.New("openai: conversation doesn't end with the reply")
+
+// Regenerate discards the reply at index, which the conversation must end with, and gets a new one in a single
+// message. The old reply is kept if the request fails.
+func (c *Conversation) Regenerate(ctx context.Context, index int) (Exchange, error) {
+	c.busy.Lock()
+	defer c.busy.Unlock()
+
+	last, err := c.dropReply(index)
+	if err != nil {
+		return Exchange{}, err
+	}
+
+	exchange, err := c.complete(ctx)
+	if err != nil {
+		c.restoreReply(last)
+		return Exchange{}, err
+	}
+	return exchange, nil
+}
+
+// RegenerateStream discards the reply at index, which the conversation must end with, and streams back a new one, like
+// ChatStream. The old reply is kept if the request fails.
+func (c *Conversation) RegenerateStream(ctx context.Context, index int) (chan string, chan StreamResult, error) {
+	c.busy.Lock()
+
+	last, err := c.dropReply(index)
+	if err != nil {
+		c.busy.Unlock()
+		return nil, nil, err
+	}
+
+	return c.stream(ctx, Message{}, func() { c.restoreReply(last) })
+}
+
+// dropReply removes the assistant's reply at index and returns it, if the conversation ends with it and neither the
+// reply nor its question has been summarized yet. c.busy must be held.
+func (c *Conversation) dropReply(index int) (Message, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if len(c.Messages) < 2 {
+		return Message{}, ErrNoReply
+	}
+	if last := c.Messages[len(c.Messages)-1]; last.Role != ROLE_ASSISTANT || last.Index != index {
+		return Message{}, ErrNoReply
+	}
+	// A new reply would take the old one's index, which withSummary hides along with the question
+	if c.Summary != nil && c.Messages[len(c.Messages)-2].Index <= c.Summary.EndIndex {
+		return Message{}, ErrNoReply
+	}
+
+	last := c.Messages[len(c.Messages)-1]
+	c.Messages = c.Messages[:len(c.Messages)-1]
+	return last, nil
+}
+
+// restoreReply puts back the reply removed by dropReply. c.busy must be held.
+func (c *Conversation) restoreReply(last Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.Messages = append(c.Messages, last)
+}
+
+// complete gets a reply to the conversation so far in a single message, adds it to Messages and returns it with the
+// request's usage. c.busy must be held.
+func (c *Conversation) complete(ctx context.Context) (Exchange, error) {
+	chatResponse, err := c.provider.Chat(ctx, c.request())
+	if err != nil {
+		return Exchange{}, err
+	}
+	if len(chatResponse.Choices) == 0 {
+		return Exchange{}, fmt.Errorf("openai: response contained no choices")
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
 
 	msg := chatResponse.Choices[0].Message
 	msg.Index = len(c.Messages) + 1
 
 	c.Messages = append(c.Messages, msg)
 	c.Usage = chatResponse.Usage
-	return chatResponse.Choices[0].Message.Content, nil
+	return Exchange{Reply: msg, Usage: c.Usage}, nil
 }
 
-func (c *Conversation) ChatStream(message string) (chan string, chan error, error) {
-	c.mu.Lock()
-
-	c.Messages = append(c.Messages, Message{Role: ROLE_USER, Content: message})
-	chatResponse, err := c.client.sendChat(ChatRequest{
-		Model:        c.Model,
-		Messages:     c.Messages,
-		Temperature:  c.Temperature,
-		Stream:       true,
-		TotalChoices: c.TotalChoices,
-	})
+// stream streams a reply to the conversation so far, adding it to Messages once complete. c.busy must be held, and is
+// released once the stream is done. user is the message being answered, for the result, and rollback undoes the
+// caller's changes to Messages if the request fails.
+func (c *Conversation) stream(ctx context.Context, user Message, rollback func()) (chan string, chan StreamResult, error) {
+	request := c.request()
+	stream, err := c.provider.ChatStream(ctx, request)
 	if err != nil {
+		rollback()
+		c.busy.Unlock()
 		return nil, nil, err
 	}
 
 	chunks := make(chan string)
-	errChan := make(chan error)
-	newMessage := Message{Role: ROLE_ASSISTANT, Content: ""}
+	results := make(chan StreamResult, 1) // Buffered so the stream can finish without the reader waiting on it
 
 	go func() {
 		defer func() {
-			_ = chatResponse.HTTPBody.Close()
+			_ = stream.Close()
 			close(chunks)
-			close(errChan)
-			c.mu.Unlock()
+			close(results)
+			c.busy.Unlock()
 		}()
 
-		scanner := bufio.NewScanner(chatResponse.HTTPBody)
-		for scanner.Scan() {
-			newText := scanner.Text()
-			newMessage.Content += newText
-			rawChunk := strings.TrimPrefix(newText, "data: ")
-
-			if rawChunk == "" {
-				continue
-			}
-
-			var chunk Chunk
-			if err := json.Unmarshal([]byte(rawChunk), &chunk); err != nil {
-				errChan <- err
-				break
-			}
-
-			if chunk.Choices[0].FinishReason != nil {
-				break
-			}
-
-			text := chunk.Choices[0].Delta.Content
-			c.Messages[len(c.Messages)-1].Content += text
-			chunks <- text
+		newMessage := Message{Role: ROLE_ASSISTANT, Content: ""}
+		usage, err := readStream(stream, &newMessage, chunks)
+		if err != nil {
+			rollback()
+			results <- StreamResult{Err: err}
+			return
 		}
 
-		if err := scanner.Err(); err != nil {
-			errChan <- err
+		// Not every provider reports usage for streams, count it ourselves when it doesn't
+		if usage == nil {
+			promptTokens := countTokens(request.Model, request.Messages)
+			completionTokens := countTokens(request.Model, []Message{newMessage})
+			usage = &Usage{CompletionTokens: completionTokens, PromptTokens: promptTokens, TotalTokens: promptTokens + completionTokens}
 		}
 
+		c.mu.Lock()
+		newMessage.Index = len(c.Messages) + 1
 		c.Messages = append(c.Messages, newMessage)
+		c.Usage = *usage
+		c.mu.Unlock()
+
+		results <- StreamResult{Exchange: Exchange{User: user, Reply: newMessage, Usage: *usage}}
 	}()
 
-	return chunks, errChan, nil
+	return chunks, results, nil
+}
+
+// readStream reads a streamed reply until it is complete, appending its text to msg and sending it on chunks as it
+// arrives. It returns the usage if the provider reported it.
+func readStream(stream Stream, msg *Message, chunks chan string) (*Usage, error) {
+	for {
+		text, err := stream.Recv()
+		if err == io.EOF {
+			return stream.Usage(), nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		msg.Content += text
+		chunks <- text
+	}
 }
@@ -0,0 +1,102 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+// blockingProvider answers once release is closed, after letting the test know the request has started
+type blockingProvider struct {
+	fakeProvider
+	started chan struct{}
+	release chan struct{}
+}
+
+func (p blockingProvider) Chat(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	close(p.started)
+	<-p.release
+
+	var response ChatResponse
+	response.Choices = append(response.Choices, struct {
+		FinishReason string  `json:"finish_reason"`
+		Index        int     `json:"index"`
+		Message      Message `json:"message"`
+	}{Message: Message{Role: ROLE_ASSISTANT, Content: "Hello"}})
+	return response, nil
+}
+
+func TestSettingsDontWaitOnRequests(t *testing.T) {
+	provider := blockingProvider{started: make(chan struct{}), release: make(chan struct{})}
+	c := NewConversation("gpt-4o", "Be helpful.", provider)
+
+	done := make(chan Exchange)
+	go func() {
+		exchange, err := c.Chat(context.Background(), Message{Content: "Hi"})
+		if err != nil {
+			t.Errorf("Chat() error = %v", err)
+		}
+		done <- exchange
+	}()
+	<-provider.started
+
+	read := make(chan struct{})
+	go func() {
+		c.SetModel("gpt-4.1")
+		c.SetTemperature(nil)
+		c.SetTotalChoices(2)
+		c.UpdatePrompt("Be brief.")
+		_ = c.History()
+		_ = c.Settings()
+		_ = c.LastUsage()
+		if _, err := c.PromptTokens("Hello?"); err != nil {
+			t.Errorf("PromptTokens() error = %v", err)
+		}
+		close(read)
+	}()
+
+	select {
+	case <-read:
+	case <-time.After(5 * time.Second):
+		t.Fatal("settings waited on the request in progress")
+	}
+
+	close(provider.release)
+	exchange := <-done
+	if exchange.User.Index != 2 || exchange.Reply.Index != 3 {
+		t.Errorf("exchange indexes = %d and %d, want 2 and 3", exchange.User.Index, exchange.Reply.Index)
+	}
+	if got := c.Settings(); got.Model != "gpt-4.1" || got.SystemPrompt != "Be brief." || got.TotalChoices != 2 {
+		t.Errorf("settings = %+v, want the ones set during the request", got)
+	}
+}
+
+func TestRegenerateSummarizedReply(t *testing.T) {
+	c := NewConversation("gpt-4o", "Be helpful.", fakeProvider{body: streamBody})
+	c.Messages = append(c.Messages,
+		Message{Index: 2, Role: ROLE_USER, Content: "Hi"},
+		Message{Index: 3, Role: ROLE_ASSISTANT, Content: "Hello"},
+	)
+
+	for _, endIndex := range []int{2, 3} {
+		c.Summary = &Summary{StartIndex: 2, EndIndex: endIndex, Content: "They said hi."}
+		if _, err := c.Regenerate(context.Background(), 3); !errors.Is(err, ErrNoReply) {
+			t.Errorf("Regenerate() with summary ending at %d, error = %v, want %v", endIndex, err, ErrNoReply)
+		}
+		if len(c.Messages) != 3 {
+			t.Fatalf("Regenerate() with summary ending at %d left %d messages, want 3", endIndex, len(c.Messages))
+		}
+	}
+
+	c.Summary = &Summary{StartIndex: 1, EndIndex: 1, Content: "Nothing yet."}
+	chunks, results, err := c.RegenerateStream(context.Background(), 3)
+	if err != nil {
+		t.Fatalf("RegenerateStream() with summary ending at 1, error = %v", err)
+	}
+	for range chunks {
+	}
+	if result := <-results; result.Err != nil || result.Reply.Index != 3 {
+		t.Errorf("RegenerateStream() result = %+v, want a reply at index 3", result)
+	}
+}
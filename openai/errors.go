@@ -0,0 +1,76 @@
+package openai
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"time"
+)
+
+// APIError is an error response returned by the API
+type APIError struct {
+	StatusCode int
+	Type       string        `json:"type"`
+	Code       string        `json:"code"`
+	Param      string        `json:"param"`
+	Message    string        `json:"message"`
+	RetryAfter time.Duration `json:"-"` // How long the server asked us to wait before retrying, if it did
+}
+
+func (e *APIError) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("openai: request failed with status %d", e.StatusCode)
+	}
+	return fmt.Sprintf("openai: request failed with status %d: %s", e.StatusCode, e.Message)
+}
+
+// RateLimitError is returned when a request is throttled or the account is out of quota
+type RateLimitError struct{ *APIError }
+
+// AuthError is returned when the API token is missing, invalid or lacks access to the resource
+type AuthError struct{ *APIError }
+
+// ContextLengthError is returned when the conversation no longer fits in the model's context window
+type ContextLengthError struct{ *APIError }
+
+// ServerError is returned when the API fails on its side
+type ServerError struct{ *APIError }
+
+func (e *RateLimitError) Unwrap() error     { return e.APIError }
+func (e *AuthError) Unwrap() error          { return e.APIError }
+func (e *ContextLengthError) Unwrap() error { return e.APIError }
+func (e *ServerError) Unwrap() error        { return e.APIError }
+
+// errorFromResponse builds a typed error from a non-2xx response, falling back to *APIError
+func errorFromResponse(resp *http.Response) error {
+	apiErr := &APIError{StatusCode: resp.StatusCode}
+
+	// The body is usually {"error": {...}}, but OpenAI-compatible servers don't always follow suit
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1<<20))
+	var errResponse struct {
+		Error *APIError `json:"error"`
+	}
+	if err := json.Unmarshal(body, &errResponse); err == nil && errResponse.Error != nil {
+		apiErr = errResponse.Error
+		apiErr.StatusCode = resp.StatusCode
+	} else {
+		apiErr.Message = string(body)
+	}
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= http.StatusInternalServerError {
+		apiErr.RetryAfter = retryAfter(resp.Header, resp.StatusCode == http.StatusTooManyRequests)
+	}
+
+	switch {
+	case apiErr.Code == "context_length_exceeded":
+		return &ContextLengthError{apiErr}
+	case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+		return &AuthError{apiErr}
+	case resp.StatusCode == http.StatusTooManyRequests:
+		return &RateLimitError{apiErr}
+	case resp.StatusCode >= http.StatusInternalServerError:
+		return &ServerError{apiErr}
+	default:
+		return apiErr
+	}
+}
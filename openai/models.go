@@ -0,0 +1,57 @@
+package openai
+
+import (
+	"strings"
+)
+
+// modelInfo is what is known about a family of models without asking the API
+type modelInfo struct {
+	encoding      string // Tokenizer encoding, see EncodingForModel
+	contextWindow int    // Tokens the model can take in, prompt and reply combined
+}
+
+// knownModels are OpenAI's chat models, matched by prefix with the longest prefix winning
+var knownModels = map[string]modelInfo{
+	"gpt-3.5-turbo":          {ENCODING_CL100K, 16385},
+	"gpt-3.5-turbo-instruct": {ENCODING_CL100K, 4096},
+	"gpt-4":                  {ENCODING_CL100K, 8192},
+	"gpt-4-32k":              {ENCODING_CL100K, 32768},
+	"gpt-4-turbo":            {ENCODING_CL100K, 128000},
+	"gpt-4-0125-preview":     {ENCODING_CL100K, 128000},
+	"gpt-4-1106-preview":     {ENCODING_CL100K, 128000},
+	"gpt-4-vision":           {ENCODING_CL100K, 128000},
+	"gpt-4o":                 {ENCODING_O200K, 128000},
+	"chatgpt-4o":             {ENCODING_O200K, 128000},
+	"gpt-4.1":                {ENCODING_O200K, 1047576},
+	"gpt-4.5":                {ENCODING_O200K, 128000},
+	"gpt-5":                  {ENCODING_O200K, 400000},
+	"o1":                     {ENCODING_O200K, 200000},
+	"o3":                     {ENCODING_O200K, 200000},
+	"o4":                     {ENCODING_O200K, 200000},
+}
+
+// DEFAULT_CONTEXT_WINDOW is assumed for models that aren't known, such as those served by OpenAI-compatible servers
+const DEFAULT_CONTEXT_WINDOW = 8192
+
+// lookupModel returns what is known about model, falling back to cl100k_base and DEFAULT_CONTEXT_WINDOW for models
+// that aren't known
+func lookupModel(model Model) modelInfo {
+	info, longest := modelInfo{encoding: ENCODING_CL100K, contextWindow: DEFAULT_CONTEXT_WINDOW}, 0
+	for prefix, known := range knownModels {
+		if strings.HasPrefix(string(model), prefix) && len(prefix) > longest {
+			info, longest = known, len(prefix)
+		}
+	}
+	return info
+}
+
+// EncodingForModel returns the name of the tokenizer encoding model uses. Unknown models, such as those served by
+// OpenAI-compatible servers, are assumed to use cl100k_base.
+func EncodingForModel(model Model) string {
+	return lookupModel(model).encoding
+}
+
+// ContextWindow returns how many tokens model can take in, prompt and reply combined
+func ContextWindow(model Model) int {
+	return lookupModel(model).contextWindow
+}
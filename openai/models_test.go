@@ -0,0 +1,25 @@
+package openai
+
+import "testing"
+
+func TestLookupModel(t *testing.T) {
+	tests := []struct {
+		model Model
+		want  modelInfo
+	}{
+		{"gpt-3.5-turbo-0125", modelInfo{ENCODING_CL100K, 16385}},
+		{"gpt-4-32k-0613", modelInfo{ENCODING_CL100K, 32768}},
+		{"gpt-4o-mini", modelInfo{ENCODING_O200K, 128000}},
+		{"chatgpt-4o-latest", modelInfo{ENCODING_O200K, 128000}},
+		{"gpt-4.5-preview", modelInfo{ENCODING_O200K, 128000}},
+		{"gpt-5-mini", modelInfo{ENCODING_O200K, 400000}},
+		{"o3-mini", modelInfo{ENCODING_O200K, 200000}},
+		{"llama3:8b", modelInfo{ENCODING_CL100K, DEFAULT_CONTEXT_WINDOW}},
+	}
+
+	for _, tt := range tests {
+		if got := lookupModel(tt.model); got != tt.want {
+			t.Errorf("lookupModel(%q) = %+v, want %+v", tt.model, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,32 @@
+package openai
+
+import (
+	"strings"
+)
+
+// MAX_NAME_LENGTH is the longest name the API accepts on a message
+const MAX_NAME_LENGTH = 64
+
+// SanitizeName turns a display name into one the API accepts on a message, which may only hold letters, digits,
+// underscores and dashes. Spaces and other characters are replaced by underscores. It returns an empty string if
+// nothing of the name is left.
+func SanitizeName(name string) string {
+	var sb strings.Builder
+	for _, r := range strings.TrimSpace(name) {
+		switch {
+		case r >= 'a' && r <= 'z', r >= 'A' && r <= 'Z', r >= '0' && r <= '9', r == '_', r == '-':
+			sb.WriteRune(r)
+		default:
+			sb.WriteRune('_')
+		}
+		if sb.Len() == MAX_NAME_LENGTH {
+			break
+		}
+	}
+
+	sanitized := sb.String()
+	if strings.Trim(sanitized, "_") == "" {
+		return ""
+	}
+	return sanitized
+}
@@ -0,0 +1,16 @@
+package openai
+
+import (
+	"context"
+)
+
+// Provider is a chat completion backend a Conversation can talk to. Client is the OpenAI implementation.
+// Requests are abandoned when ctx is cancelled.
+type Provider interface {
+	// Chat sends a request and returns the complete response.
+	Chat(ctx context.Context, request ChatRequest) (ChatResponse, error)
+	// ChatStream sends a request and returns the reply as it is generated. The caller must close the stream.
+	ChatStream(ctx context.Context, request ChatRequest) (Stream, error)
+	// ListModels returns the models available to the provider.
+	ListModels(ctx context.Context) ([]Model, error)
+}
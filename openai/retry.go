@@ -0,0 +1,104 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// RetryPolicy controls how failed requests are retried. Requests are retried on rate limits, server errors and
+// network errors, waiting as long as the server asks when it says so and with jittered exponential backoff otherwise.
+type RetryPolicy struct {
+	MaxRetries int           // Retries after the first attempt, 0 disables retrying
+	BaseDelay  time.Duration // Upper bound of the first backoff, doubled on every attempt
+	MaxDelay   time.Duration // Longest the client will wait before a retry
+}
+
+// RetryFunc is called before a request is retried, with the attempt about to be made (starting at 1),
+// how long the client will wait first and the error that caused the retry.
+type RetryFunc func(attempt int, delay time.Duration, err error)
+
+// DefaultRetryPolicy is used when no retry policy is configured
+var DefaultRetryPolicy = RetryPolicy{MaxRetries: 3, BaseDelay: time.Second, MaxDelay: 30 * time.Second}
+
+// retryable reports whether a request sent with ctx that failed with err may succeed if sent again
+func retryable(ctx context.Context, err error) bool {
+	var (
+		rateLimitErr *RateLimitError
+		serverErr    *ServerError
+		opErr        *net.OpError
+		netErr       net.Error
+	)
+
+	switch {
+	case ctx.Err() != nil, errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		// The request was abandoned, sending it again would be too
+		return false
+	case errors.As(err, &rateLimitErr):
+		// Retrying won't top up an account that is out of credits
+		return rateLimitErr.Code != "insufficient_quota"
+	case errors.As(err, &serverErr):
+		return true
+	case errors.As(err, &opErr), errors.Is(err, io.ErrUnexpectedEOF):
+		return true
+	case errors.As(err, &netErr):
+		// Every *url.Error is a net.Error, only its own timeouts are worth retrying
+		return netErr.Timeout()
+	default:
+		return false
+	}
+}
+
+// delay returns how long to wait before the given retry attempt, and false if the server asked for longer than MaxDelay
+func (p RetryPolicy) delay(attempt int, err error) (time.Duration, bool) {
+	var apiErr *APIError
+	if errors.As(err, &apiErr) && apiErr.RetryAfter > 0 {
+		return apiErr.RetryAfter, apiErr.RetryAfter <= p.MaxDelay
+	}
+
+	backoff := p.BaseDelay << (attempt - 1)
+	if backoff > p.MaxDelay || backoff <= 0 {
+		backoff = p.MaxDelay
+	}
+	if backoff <= 0 {
+		return 0, true
+	}
+
+	// Full jitter, so clients that failed together don't retry together
+	return time.Duration(rand.Int63n(int64(backoff))) + 1, true
+}
+
+// retryAfter reads how long the server asked us to wait. An explicit Retry-After header comes first; otherwise, when
+// rate limited, it waits for the exhausted limits to reset as told by the x-ratelimit-reset-* headers.
+func retryAfter(header http.Header, rateLimited bool) time.Duration {
+	if v := header.Get("Retry-After"); v != "" {
+		if seconds, err := strconv.Atoi(v); err == nil {
+			return max(time.Duration(seconds)*time.Second, 0)
+		}
+		if t, err := http.ParseTime(v); err == nil {
+			return max(time.Until(t), 0)
+		}
+	}
+
+	if !rateLimited {
+		return 0
+	}
+
+	// OpenAI reports when each limit resets as a duration such as "1s" or "6m0s", on every 429. Only the limits which
+	// have run out matter, the others may take far longer to reset without holding up the request.
+	var wait time.Duration
+	for _, limit := range []string{"requests", "tokens"} {
+		if header.Get("x-ratelimit-remaining-"+limit) != "0" {
+			continue
+		}
+		if d, err := time.ParseDuration(header.Get("x-ratelimit-reset-" + limit)); err == nil && d > wait {
+			wait = d
+		}
+	}
+	return wait
+}
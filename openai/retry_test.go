@@ -0,0 +1,168 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// timeoutError is a net.Error reporting a timeout, like the http.Client's own
+type timeoutError struct{}
+
+func (timeoutError) Error() string   { return "timeout" }
+func (timeoutError) Timeout() bool   { return true }
+func (timeoutError) Temporary() bool { return true }
+
+func TestRetryable(t *testing.T) {
+	cancelled, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	dialErr := &url.Error{Op: "Post", URL: "http://localhost", Err: &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}}
+
+	tests := []struct {
+		name string
+		ctx  context.Context
+		err  error
+		want bool
+	}{
+		{"rate limited", context.Background(), &RateLimitError{&APIError{StatusCode: 429}}, true},
+		{"out of quota", context.Background(), &RateLimitError{&APIError{StatusCode: 429, Code: "insufficient_quota"}}, false},
+		{"server error", context.Background(), &ServerError{&APIError{StatusCode: 503}}, true},
+		{"bad request", context.Background(), &APIError{StatusCode: 400}, false},
+		{"auth error", context.Background(), &AuthError{&APIError{StatusCode: 401}}, false},
+		{"connection refused", context.Background(), dialErr, true},
+		{"unexpected eof", context.Background(), &url.Error{Op: "Post", URL: "http://localhost", Err: io.ErrUnexpectedEOF}, true},
+		{"timeout", context.Background(), &url.Error{Op: "Post", URL: "http://localhost", Err: timeoutError{}}, true},
+		{"unsupported scheme", context.Background(), &url.Error{Op: "Post", URL: "localhost", Err: errors.New("unsupported protocol scheme \"\"")}, false},
+		{"cancelled", context.Background(), &url.Error{Op: "Post", URL: "http://localhost", Err: context.Canceled}, false},
+		{"deadline", context.Background(), fmt.Errorf("reading: %w", context.DeadlineExceeded), false},
+		{"context done", cancelled, dialErr, false},
+		{"context done while rate limited", cancelled, &RateLimitError{&APIError{StatusCode: 429}}, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := retryable(tt.ctx, tt.err); got != tt.want {
+				t.Errorf("retryable(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestDelay(t *testing.T) {
+	policy := RetryPolicy{MaxRetries: 3, BaseDelay: time.Second, MaxDelay: 10 * time.Second}
+
+	t.Run("retry after", func(t *testing.T) {
+		err := &RateLimitError{&APIError{StatusCode: 429, RetryAfter: 2 * time.Second}}
+		if d, ok := policy.delay(1, err); d != 2*time.Second || !ok {
+			t.Errorf("delay() = %v, %v, want 2s, true", d, ok)
+		}
+	})
+
+	t.Run("retry after too long", func(t *testing.T) {
+		err := &RateLimitError{&APIError{StatusCode: 429, RetryAfter: time.Minute}}
+		if _, ok := policy.delay(1, err); ok {
+			t.Error("delay() ok = true, want false")
+		}
+	})
+
+	t.Run("backoff", func(t *testing.T) {
+		for attempt, limit := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 10: 10 * time.Second, 100: 10 * time.Second} {
+			for i := 0; i < 100; i++ {
+				d, ok := policy.delay(attempt, &ServerError{&APIError{StatusCode: 500}})
+				if !ok || d <= 0 || d > limit {
+					t.Fatalf("delay(%d) = %v, %v, want (0, %v], true", attempt, d, ok, limit)
+				}
+			}
+		}
+	})
+}
+
+func TestRetryAfter(t *testing.T) {
+	tests := []struct {
+		name        string
+		header      map[string]string
+		rateLimited bool
+		want        time.Duration
+	}{
+		{
+			name:        "none",
+			header:      map[string]string{},
+			rateLimited: true,
+			want:        0,
+		},
+		{
+			name:        "retry after seconds",
+			header:      map[string]string{"Retry-After": "2"},
+			rateLimited: false,
+			want:        2 * time.Second,
+		},
+		{
+			name: "retry after wins over resets",
+			header: map[string]string{
+				"Retry-After":                    "2",
+				"x-ratelimit-remaining-requests": "0",
+				"x-ratelimit-reset-requests":     "20s",
+				"x-ratelimit-remaining-tokens":   "0",
+				"x-ratelimit-reset-tokens":       "6m0s",
+			},
+			rateLimited: true,
+			want:        2 * time.Second,
+		},
+		{
+			name: "exhausted limit only",
+			header: map[string]string{
+				"x-ratelimit-remaining-requests": "0",
+				"x-ratelimit-reset-requests":     "1.5s",
+				"x-ratelimit-remaining-tokens":   "3000",
+				"x-ratelimit-reset-tokens":       "6m0s",
+			},
+			rateLimited: true,
+			want:        1500 * time.Millisecond,
+		},
+		{
+			name: "both exhausted",
+			header: map[string]string{
+				"x-ratelimit-remaining-requests": "0",
+				"x-ratelimit-reset-requests":     "1s",
+				"x-ratelimit-remaining-tokens":   "0",
+				"x-ratelimit-reset-tokens":       "20s",
+			},
+			rateLimited: true,
+			want:        20 * time.Second,
+		},
+		{
+			name: "resets ignored when not rate limited",
+			header: map[string]string{
+				"x-ratelimit-remaining-requests": "0",
+				"x-ratelimit-reset-requests":     "1s",
+			},
+			rateLimited: false,
+			want:        0,
+		},
+		{
+			name:        "retry after in the past",
+			header:      map[string]string{"Retry-After": time.Now().Add(-time.Hour).UTC().Format(http.TimeFormat)},
+			rateLimited: true,
+			want:        0,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			header := http.Header{}
+			for k, v := range tt.header {
+				header.Set(k, v)
+			}
+			if got := retryAfter(header, tt.rateLimited); got != tt.want {
+				t.Errorf("retryAfter() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,116 @@
+package openai
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Event is a single server-sent event, as described in https://html.spec.whatwg.org/multipage/server-sent-events.html
+type Event struct {
+	ID    string
+	Event string // Event type, empty for the default "message" type
+	Data  string // The event's data lines, joined by newlines
+	Retry int    // Reconnection time in milliseconds the server asked for, 0 if unset
+}
+
+// eventReader decodes server-sent events from a stream
+type eventReader struct {
+	scanner *bufio.Scanner
+}
+
+func newEventReader(r io.Reader) *eventReader {
+	scanner := bufio.NewScanner(r)
+	// A single chunk can be larger than the default 64KB token limit
+	scanner.Buffer(make([]byte, 0, 64*1024), 1024*1024)
+	scanner.Split(scanLines)
+	return &eventReader{scanner: scanner}
+}
+
+// Next returns the next event in the stream, or io.EOF once the stream has ended
+func (r *eventReader) Next() (Event, error) {
+	var (
+		event   Event
+		data    []string
+		hasData bool
+	)
+
+	for r.scanner.Scan() {
+		line := r.scanner.Text()
+
+		// A blank line dispatches the event, unless no data has been read for it
+		if line == "" {
+			if !hasData {
+				event = Event{}
+				continue
+			}
+			event.Data = strings.Join(data, "\n")
+			return event, nil
+		}
+
+		// Lines starting with a colon are comments, often used as keep-alives
+		if strings.HasPrefix(line, ":") {
+			continue
+		}
+
+		field, value, _ := strings.Cut(line, ":")
+		value = strings.TrimPrefix(value, " ")
+
+		switch field {
+		case "data":
+			data = append(data, value)
+			hasData = true
+		case "event":
+			event.Event = value
+		case "id":
+			event.ID = value
+		case "retry":
+			if retry, err := strconv.Atoi(value); err == nil {
+				event.Retry = retry
+			}
+		}
+	}
+
+	if err := r.scanner.Err(); err != nil {
+		return Event{}, err
+	}
+
+	// The stream ended without a trailing blank line, dispatch what we have rather than lose it
+	if hasData {
+		event.Data = strings.Join(data, "\n")
+		return event, nil
+	}
+
+	return Event{}, io.EOF
+}
+
+// scanLines is bufio.ScanLines, but also accepting a lone "\r" as a line ending as the spec requires
+func scanLines(data []byte, atEOF bool) (advance int, token []byte, err error) {
+	if atEOF && len(data) == 0 {
+		return 0, nil, nil
+	}
+
+	if i := bytes.IndexAny(data, "\r\n"); i >= 0 {
+		if data[i] == '\n' {
+			return i + 1, data[:i], nil
+		}
+		// A "\r" might be the first half of a "\r\n" split across reads
+		if i+1 < len(data) {
+			if data[i+1] == '\n' {
+				return i + 2, data[:i], nil
+			}
+			return i + 1, data[:i], nil
+		}
+		if atEOF {
+			return i + 1, data[:i], nil
+		}
+		return 0, nil, nil
+	}
+
+	if atEOF {
+		return len(data), data, nil
+	}
+	return 0, nil, nil
+}
@@ -0,0 +1,92 @@
+package openai
+
+import (
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/iotest"
+)
+
+func TestEventReader(t *testing.T) {
+	tests := []struct {
+		name  string
+		input string
+		want  []Event
+	}{
+		{
+			name:  "lf",
+			input: "data: one\n\ndata: two\n\n",
+			want:  []Event{{Data: "one"}, {Data: "two"}},
+		},
+		{
+			name:  "crlf",
+			input: "data: one\r\n\r\ndata: two\r\n\r\n",
+			want:  []Event{{Data: "one"}, {Data: "two"}},
+		},
+		{
+			name:  "lone cr",
+			input: "data: one\r\rdata: two\r\r",
+			want:  []Event{{Data: "one"}, {Data: "two"}},
+		},
+		{
+			name:  "comments",
+			input: ": keep-alive\n\n: processing\ndata: one\n\n",
+			want:  []Event{{Data: "one"}},
+		},
+		{
+			name:  "multi-line data",
+			input: "data: one\ndata:two\ndata\n\n",
+			want:  []Event{{Data: "one\ntwo\n"}},
+		},
+		{
+			name:  "fields",
+			input: "id: 7\nevent: chunk\nretry: 3000\ndata: one\n\n",
+			want:  []Event{{ID: "7", Event: "chunk", Retry: 3000, Data: "one"}},
+		},
+		{
+			name:  "no data",
+			input: "event: ping\n\ndata: one\n\n",
+			want:  []Event{{Data: "one"}},
+		},
+		{
+			name:  "no trailing blank line",
+			input: "data: one\n\ndata: two",
+			want:  []Event{{Data: "one"}, {Data: "two"}},
+		},
+		{
+			name:  "done",
+			input: "data: {}\n\ndata: [DONE]\n\n",
+			want:  []Event{{Data: "{}"}, {Data: "[DONE]"}},
+		},
+	}
+
+	for _, tt := range tests {
+		// Reading a byte at a time splits every "\r\n" across reads
+		readers := map[string]func() io.Reader{
+			"whole":    func() io.Reader { return strings.NewReader(tt.input) },
+			"one byte": func() io.Reader { return iotest.OneByteReader(strings.NewReader(tt.input)) },
+		}
+		for readerName, reader := range readers {
+			t.Run(tt.name+"/"+readerName, func(t *testing.T) {
+				events := newEventReader(reader())
+
+				var got []Event
+				for {
+					event, err := events.Next()
+					if err == io.EOF {
+						break
+					}
+					if err != nil {
+						t.Fatalf("Next() error = %v", err)
+					}
+					got = append(got, event)
+				}
+
+				if !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("events = %+v, want %+v", got, tt.want)
+				}
+			})
+		}
+	}
+}
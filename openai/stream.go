@@ -0,0 +1,71 @@
+package openai
+
+import (
+	"encoding/json"
+	"io"
+)
+
+// Stream is a reply which is still being generated, only its first choice is streamed
+type Stream interface {
+	// Recv returns the next piece of the reply's text, or io.EOF once the reply is complete
+	Recv() (string, error)
+	// Usage returns the tokens the request used once Recv has returned io.EOF, or nil if the provider didn't report it
+	Usage() *Usage
+	// Close releases the stream, it must be called once done with it
+	Close() error
+}
+
+// chunkStream decodes the chunks of a streamed completion from the server-sent events of an OpenAI response body
+type chunkStream struct {
+	body   io.ReadCloser
+	events *eventReader
+	usage  *Usage
+	done   bool
+}
+
+func newChunkStream(body io.ReadCloser) *chunkStream {
+	return &chunkStream{body: body, events: newEventReader(body)}
+}
+
+func (s *chunkStream) Recv() (string, error) {
+	for !s.done {
+		event, err := s.events.Next()
+		if err == io.EOF || (err == nil && event.Data == "[DONE]") {
+			s.done = true
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+
+		var chunk Chunk
+		if err := json.Unmarshal([]byte(event.Data), &chunk); err != nil {
+			return "", err
+		}
+		if chunk.Error != nil {
+			return "", chunk.Error
+		}
+		if chunk.Usage != nil {
+			s.usage = chunk.Usage
+		}
+
+		var text string
+		for _, choice := range chunk.Choices {
+			if choice.Index == 0 && choice.Delta != nil {
+				text += choice.Delta.Content
+			}
+		}
+		if text != "" {
+			return text, nil
+		}
+	}
+	return "", io.EOF
+}
+
+func (s *chunkStream) Usage() *Usage {
+	return s.usage
+}
+
+func (s *chunkStream) Close() error {
+	return s.body.Close()
+}
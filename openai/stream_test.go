@@ -0,0 +1,117 @@
+package openai
+
+import (
+	"context"
+	"errors"
+	"io"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// streamBody is a streamed completion as the OpenAI API sends it, with a keep-alive, a second choice and usage
+const streamBody = `: keep-alive
+
+data: {"choices":[{"index":0,"delta":{"role":"assistant","content":""}}]}
+
+data: {"choices":[{"index":0,"delta":{"content":"Hello"}},{"index":1,"delta":{"content":"Bonjour"}}]}
+
+data: {"choices":[{"index":0,"delta":{"content":" there"}}]}
+
+data: {"choices":[{"index":0,"delta":{},"finish_reason":"stop"}]}
+
+data: {"choices":[],"usage":{"completion_tokens":2,"prompt_tokens":10,"total_tokens":12}}
+
+data: [DONE]
+
+`
+
+// fakeProvider streams body as the reply to every request
+type fakeProvider struct {
+	body string
+}
+
+func (p fakeProvider) Chat(ctx context.Context, request ChatRequest) (ChatResponse, error) {
+	return ChatResponse{}, errors.New("not implemented")
+}
+
+func (p fakeProvider) ChatStream(ctx context.Context, request ChatRequest) (Stream, error) {
+	return newChunkStream(io.NopCloser(strings.NewReader(p.body))), nil
+}
+
+func (p fakeProvider) ListModels(ctx context.Context) ([]Model, error) {
+	return nil, nil
+}
+
+func TestReadStream(t *testing.T) {
+	chunks := make(chan string, 10)
+	msg := Message{Index: 3, Role: ROLE_ASSISTANT}
+
+	usage, err := readStream(newChunkStream(io.NopCloser(strings.NewReader(streamBody))), &msg, chunks)
+	if err != nil {
+		t.Fatalf("readStream() error = %v", err)
+	}
+	close(chunks)
+
+	var got []string
+	for chunk := range chunks {
+		got = append(got, chunk)
+	}
+	if want := []string{"Hello", " there"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("chunks = %q, want %q", got, want)
+	}
+	if want := (Message{Index: 3, Role: ROLE_ASSISTANT, Content: "Hello there"}); msg != want {
+		t.Errorf("message = %+v, want %+v", msg, want)
+	}
+	if want := (Usage{CompletionTokens: 2, PromptTokens: 10, TotalTokens: 12}); usage == nil || *usage != want {
+		t.Errorf("usage = %+v, want %+v", usage, want)
+	}
+}
+
+func TestReadStreamError(t *testing.T) {
+	body := "data: {\"choices\":[{\"index\":0,\"delta\":{\"content\":\"Hel\"}}]}\n\n" +
+		"data: {\"error\":{\"type\":\"server_error\",\"message\":\"overloaded\"}}\n\n"
+	chunks := make(chan string, 10)
+	msg := Message{Index: 3, Role: ROLE_ASSISTANT}
+
+	_, err := readStream(newChunkStream(io.NopCloser(strings.NewReader(body))), &msg, chunks)
+	var apiErr *APIError
+	if !errors.As(err, &apiErr) || apiErr.Message != "overloaded" {
+		t.Errorf("readStream() error = %v, want the API error", err)
+	}
+}
+
+func TestConversationChatStream(t *testing.T) {
+	c := NewConversation("gpt-4o", "Be helpful.", fakeProvider{body: streamBody})
+
+	chunks, results, err := c.ChatStream(context.Background(), Message{Content: "Hi", Name: "alice"})
+	if err != nil {
+		t.Fatalf("ChatStream() error = %v", err)
+	}
+	var text string
+	for chunk := range chunks {
+		text += chunk
+	}
+	result := <-results
+	if result.Err != nil {
+		t.Fatalf("stream error = %v", result.Err)
+	}
+
+	if text != "Hello there" {
+		t.Errorf("streamed text = %q, want %q", text, "Hello there")
+	}
+	want := []Message{
+		{Index: 1, Role: ROLE_SYSTEM, Content: "Be helpful."},
+		{Index: 2, Role: ROLE_USER, Content: "Hi", Name: "alice"},
+		{Index: 3, Role: ROLE_ASSISTANT, Content: "Hello there"},
+	}
+	if got := c.History(); !reflect.DeepEqual(got, want) {
+		t.Errorf("messages = %+v, want %+v", got, want)
+	}
+	if result.User != want[1] || result.Reply != want[2] {
+		t.Errorf("exchange = %+v, want %+v and %+v", result.Exchange, want[1], want[2])
+	}
+	if want := (Usage{CompletionTokens: 2, PromptTokens: 10, TotalTokens: 12}); result.Usage != want {
+		t.Errorf("usage = %+v, want %+v", result.Usage, want)
+	}
+}
@@ -0,0 +1,121 @@
+package openai
+
+import (
+	"context"
+	"fmt"
+	"strings"
+)
+
+// Summary is a running summary of the older turns of a conversation, sent in their place
+type Summary struct {
+	StartIndex int // Index of the first message the summary covers
+	EndIndex   int // Index of the last message the summary covers
+	Content    string
+}
+
+// Summarization configures when a conversation folds its older turns into its summary
+type Summarization struct {
+	Threshold  int // Prompt tokens past which older turns are summarized, 0 disables summarization
+	KeepRecent int // Latest messages that are always sent as they are
+}
+
+const summarizerPrompt = "You maintain a running summary of a chat between users and an assistant. " +
+	"Given the current summary and the messages that followed it, write an updated summary that keeps every fact, " +
+	"decision, open question and user preference needed to continue the conversation. " +
+	"Write it in the third person and reply with the summary only."
+
+// withSummary returns messages with the turns covered by the summary replaced by it, right after the system prompt
+func (c *Conversation) withSummary(messages []Message) []Message {
+	if c.Summary == nil || len(messages) == 0 {
+		return messages
+	}
+
+	rest := messages[1:]
+	for len(rest) > 0 && rest[0].Index <= c.Summary.EndIndex {
+		rest = rest[1:]
+	}
+
+	summary := Message{Role: ROLE_SYSTEM, Content: "Summary of the earlier conversation:\n" + c.Summary.Content}
+	return join(append(messages[:1:1], summary), rest)
+}
+
+// Summarize folds the older turns of the conversation into its summary once the prompt grows past the summarization
+// threshold, keeping the latest messages as they are. It returns the new summary, or nil if none was needed.
+// Messages is left untouched, so the full transcript is still available.
+func (c *Conversation) Summarize(ctx context.Context) (*Summary, error) {
+	// Nothing else may change the history while it is being summarized
+	c.busy.Lock()
+	defer c.busy.Unlock()
+
+	model, previous, pending := c.pendingSummary()
+	if len(pending) == 0 {
+		return nil, nil
+	}
+
+	var transcript strings.Builder
+	if previous != nil {
+		transcript.WriteString("Current summary:\n" + previous.Content + "\n\n")
+	}
+	transcript.WriteString("Messages that followed:\n")
+	for _, m := range pending {
+		speaker := string(m.Role)
+		if m.Name != "" {
+			speaker += " " + m.Name
+		}
+		transcript.WriteString(fmt.Sprintf("%s: %s\n", speaker, m.Content))
+	}
+
+	chatResponse, err := c.provider.Chat(ctx, ChatRequest{
+		Model: model,
+		Messages: []Message{
+			{Role: ROLE_SYSTEM, Content: summarizerPrompt},
+			{Role: ROLE_USER, Content: transcript.String()},
+		},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(chatResponse.Choices) == 0 {
+		return nil, fmt.Errorf("openai: response contained no choices")
+	}
+
+	summary := &Summary{StartIndex: pending[0].Index, EndIndex: pending[len(pending)-1].Index, Content: chatResponse.Choices[0].Message.Content}
+	if previous != nil {
+		summary.StartIndex = previous.StartIndex
+	}
+
+	c.mu.Lock()
+	c.Summary = summary
+	c.mu.Unlock()
+
+	return summary, nil
+}
+
+// pendingSummary returns the model, the current summary and the messages to fold into it, none if the conversation
+// doesn't need summarizing yet. The messages are copied, so they can be used without holding c.mu.
+func (c *Conversation) pendingSummary() (Model, *Summary, []Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.Summarization.Threshold <= 0 || len(c.Messages) == 0 {
+		return c.Model, c.Summary, nil
+	}
+
+	current := c.withSummary(c.Messages)
+	if countTokens(c.Model, current) <= c.Summarization.Threshold {
+		return c.Model, c.Summary, nil
+	}
+
+	// Everything after the system prompt and the previous summary that isn't among the latest messages
+	pending := c.Messages[1:]
+	if c.Summary != nil {
+		for len(pending) > 0 && pending[0].Index <= c.Summary.EndIndex {
+			pending = pending[1:]
+		}
+	}
+	keep := max(c.Summarization.KeepRecent, 0)
+	if len(pending) <= keep {
+		return c.Model, c.Summary, nil
+	}
+	return c.Model, c.Summary, append([]Message(nil), pending[:len(pending)-keep]...)
+}
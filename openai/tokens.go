@@ -0,0 +1,79 @@
+package openai
+
+import (
+	"github.com/pkoukk/tiktoken-go"
+	tiktokenloader "github.com/pkoukk/tiktoken-go-loader"
+	"sync"
+)
+
+// Encodings used by the chat models
+const (
+	ENCODING_CL100K = "cl100k_base"
+	ENCODING_O200K  = "o200k_base"
+)
+
+var (
+	encodings   = make(map[string]*tiktoken.Tiktoken)
+	encodingsMu sync.Mutex
+)
+
+func init() {
+	// Use the vocabularies bundled with the binary rather than downloading them on first use
+	tiktoken.SetBpeLoader(tiktokenloader.NewOfflineLoader())
+}
+
+// CountTokens counts the prompt tokens messages take up when sent to model, without calling the API.
+// The per-message overhead follows OpenAI's guidance for the chat models, so counts are exact for them
+// and a close estimate for models served elsewhere.
+func CountTokens(model Model, messages []Message) (int, error) {
+	encoding, err := getEncoding(EncodingForModel(model))
+	if err != nil {
+		return 0, err
+	}
+
+	tokens := 3 // Every reply is primed with <|start|>assistant<|message|>
+	for _, m := range messages {
+		tokens += 3 // <|start|>{role}<|message|>{content}<|end|>
+		tokens += len(encoding.EncodeOrdinary(string(m.Role)))
+		tokens += len(encoding.EncodeOrdinary(m.Content))
+		if m.Name != "" {
+			tokens += 1 + len(encoding.EncodeOrdinary(m.Name))
+		}
+	}
+	return tokens, nil
+}
+
+// countTokens is CountTokens, falling back to a rough estimate if the tokenizer can't be loaded
+func countTokens(model Model, messages []Message) int {
+	if tokens, err := CountTokens(model, messages); err == nil {
+		return tokens
+	}
+	return estimateTokens(messages)
+}
+
+// getEncoding loads the named encoding once and caches it, as building one is expensive
+func getEncoding(name string) (*tiktoken.Tiktoken, error) {
+	encodingsMu.Lock()
+	defer encodingsMu.Unlock()
+
+	if encoding, ok := encodings[name]; ok {
+		return encoding, nil
+	}
+
+	encoding, err := tiktoken.GetEncoding(name)
+	if err != nil {
+		return nil, err
+	}
+	encodings[name] = encoding
+	return encoding, nil
+}
+
+// estimateTokens roughly estimates how many tokens the messages take up, at about four characters per token plus the
+// few tokens each message's formatting costs
+func estimateTokens(messages []Message) int {
+	tokens := 3
+	for _, m := range messages {
+		tokens += 3 + (len(m.Role)+len(m.Content)+len(m.Name)+3)/4
+	}
+	return tokens
+}
@@ -0,0 +1,92 @@
+package openai
+
+// TruncationStrategy decides which messages of a long conversation are left out of requests so they fit the model
+type TruncationStrategy string
+
+const (
+	TRUNCATE_NONE              TruncationStrategy = "none"              // Send the whole conversation
+	TRUNCATE_SLIDING_WINDOW    TruncationStrategy = "sliding_window"    // Send the latest MaxMessages messages
+	TRUNCATE_DROP_OLDEST_PAIRS TruncationStrategy = "drop_oldest_pairs" // Drop the oldest question and answer until within budget
+	TRUNCATE_TOKEN_BUDGET      TruncationStrategy = "token_budget"      // Drop the oldest messages until within budget
+)
+
+// Valid reports whether s is one of the known strategies
+func (s TruncationStrategy) Valid() bool {
+	switch s {
+	case TRUNCATE_NONE, TRUNCATE_SLIDING_WINDOW, TRUNCATE_DROP_OLDEST_PAIRS, TRUNCATE_TOKEN_BUDGET:
+		return true
+	default:
+		return false
+	}
+}
+
+// Truncation configures how a conversation is cut down before each request. The leading system messages and the latest
+// message are always sent, and the conversation's full history is kept regardless.
+type Truncation struct {
+	Strategy      TruncationStrategy
+	MaxMessages   int // Messages kept besides the system prompt, for TRUNCATE_SLIDING_WINDOW
+	MaxTokens     int // Prompt token budget, 0 to use the model's context window less ReserveTokens
+	ReserveTokens int // Tokens left free in the context window for the reply
+}
+
+// Apply returns the messages to send to model. The returned slice may share its backing array with messages.
+func (t Truncation) Apply(model Model, messages []Message) []Message {
+	// The system prompt, and the summary that may follow it, are never dropped
+	split := 0
+	for split < len(messages)-1 && messages[split].Role == ROLE_SYSTEM {
+		split++
+	}
+	head, body := messages[:split], messages[split:]
+
+	switch t.Strategy {
+	case TRUNCATE_SLIDING_WINDOW:
+		if t.MaxMessages > 0 && len(body) > t.MaxMessages {
+			body = body[len(body)-t.MaxMessages:]
+		}
+	case TRUNCATE_DROP_OLDEST_PAIRS, TRUNCATE_TOKEN_BUDGET:
+		// Count each message once, rather than recounting the whole conversation after every drop
+		tokens := 3 // Every reply is primed with <|start|>assistant<|message|>
+		counts := make([]int, len(body))
+		for _, m := range head {
+			tokens += countTokens(model, []Message{m}) - 3
+		}
+		for i, m := range body {
+			counts[i] = countTokens(model, []Message{m}) - 3
+			tokens += counts[i]
+		}
+
+		budget := t.budget(model)
+		for len(body) > 1 && tokens > budget {
+			drop := 1
+			// Drop the oldest message along with the replies to it, up to the next user message
+			if t.Strategy == TRUNCATE_DROP_OLDEST_PAIRS {
+				for drop < len(body)-1 && body[drop].Role != ROLE_USER {
+					drop++
+				}
+			}
+			for _, count := range counts[:drop] {
+				tokens -= count
+			}
+			body, counts = body[drop:], counts[drop:]
+		}
+	default:
+		return messages
+	}
+
+	return join(head, body)
+}
+
+// budget returns the prompt token budget for model
+func (t Truncation) budget(model Model) int {
+	if t.MaxTokens > 0 {
+		return t.MaxTokens
+	}
+	return ContextWindow(model) - t.ReserveTokens
+}
+
+// join returns head followed by body in a new slice
+func join(head []Message, body []Message) []Message {
+	messages := make([]Message, 0, len(head)+len(body))
+	messages = append(messages, head...)
+	return append(messages, body...)
+}
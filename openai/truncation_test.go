@@ -0,0 +1,111 @@
+package openai
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestTruncationApply(t *testing.T) {
+	const model = Model("gpt-4o")
+	var (
+		system  = Message{Index: 1, Role: ROLE_SYSTEM, Content: "You are a helpful assistant."}
+		summary = Message{Role: ROLE_SYSTEM, Content: "Summary of the earlier conversation: they said hello."}
+		u1      = Message{Index: 2, Role: ROLE_USER, Content: "What is the capital of France?", Name: "alice"}
+		a1      = Message{Index: 3, Role: ROLE_ASSISTANT, Content: "The capital of France is Paris."}
+		u2      = Message{Index: 4, Role: ROLE_USER, Content: "And of Italy?", Name: "bob"}
+		a2      = Message{Index: 5, Role: ROLE_ASSISTANT, Content: "The capital of Italy is Rome."}
+		u3      = Message{Index: 6, Role: ROLE_USER, Content: "Which of the two is older?", Name: "alice"}
+	)
+	history := []Message{system, u1, a1, u2, a2, u3}
+
+	// promptTokens is what the messages cost as a prompt, the way Apply counts them
+	promptTokens := func(messages ...Message) int {
+		tokens := 3
+		for _, m := range messages {
+			tokens += countTokens(model, []Message{m}) - 3
+		}
+		return tokens
+	}
+
+	tests := []struct {
+		name       string
+		truncation Truncation
+		messages   []Message
+		want       []Message
+	}{
+		{
+			name:       "none",
+			truncation: Truncation{Strategy: TRUNCATE_NONE, MaxTokens: 1},
+			messages:   history,
+			want:       history,
+		},
+		{
+			name:       "sliding window",
+			truncation: Truncation{Strategy: TRUNCATE_SLIDING_WINDOW, MaxMessages: 2},
+			messages:   history,
+			want:       []Message{system, a2, u3},
+		},
+		{
+			name:       "sliding window keeps the summary",
+			truncation: Truncation{Strategy: TRUNCATE_SLIDING_WINDOW, MaxMessages: 1},
+			messages:   []Message{system, summary, u2, a2, u3},
+			want:       []Message{system, summary, u3},
+		},
+		{
+			name:       "token budget within budget",
+			truncation: Truncation{Strategy: TRUNCATE_TOKEN_BUDGET, MaxTokens: promptTokens(history...)},
+			messages:   history,
+			want:       history,
+		},
+		{
+			name:       "token budget",
+			truncation: Truncation{Strategy: TRUNCATE_TOKEN_BUDGET, MaxTokens: promptTokens(system, a2, u3)},
+			messages:   history,
+			want:       []Message{system, a2, u3},
+		},
+		{
+			name:       "drop oldest pairs",
+			truncation: Truncation{Strategy: TRUNCATE_DROP_OLDEST_PAIRS, MaxTokens: promptTokens(system, a2, u3)},
+			messages:   history,
+			want:       []Message{system, u3},
+		},
+		{
+			name:       "drop oldest pairs drops one pair",
+			truncation: Truncation{Strategy: TRUNCATE_DROP_OLDEST_PAIRS, MaxTokens: promptTokens(system, u2, a2, u3)},
+			messages:   history,
+			want:       []Message{system, u2, a2, u3},
+		},
+		{
+			name:       "latest message is always sent",
+			truncation: Truncation{Strategy: TRUNCATE_TOKEN_BUDGET, MaxTokens: 1},
+			messages:   []Message{system, summary, u1, a1, u3},
+			want:       []Message{system, summary, u3},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.truncation.Apply(model, tt.messages); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Apply() = %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestTruncationBudget(t *testing.T) {
+	tests := []struct {
+		truncation Truncation
+		model      Model
+		want       int
+	}{
+		{Truncation{MaxTokens: 1000, ReserveTokens: 4096}, "gpt-4o", 1000},
+		{Truncation{ReserveTokens: 4096}, "gpt-4o", 128000 - 4096},
+		{Truncation{ReserveTokens: 4096}, "llama3:8b", DEFAULT_CONTEXT_WINDOW - 4096},
+	}
+
+	for _, tt := range tests {
+		if got := tt.truncation.budget(tt.model); got != tt.want {
+			t.Errorf("%+v.budget(%q) = %d, want %d", tt.truncation, tt.model, got, tt.want)
+		}
+	}
+}
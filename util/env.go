@@ -0,0 +1,67 @@
+package util
+
+import (
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// EnvString returns the value of the environment variable key, or fallback if it is unset or empty
+func EnvString(key string, fallback string) string {
+	if v := os.Getenv(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// EnvInt returns the integer value of the environment variable key, or fallback if it is unset or not a number
+func EnvInt(key string, fallback int) int {
+	v, err := strconv.Atoi(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// EnvBool returns the boolean value of the environment variable key, or fallback if it is unset or not a boolean
+func EnvBool(key string, fallback bool) bool {
+	v, err := strconv.ParseBool(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// EnvDuration returns the value of the environment variable key parsed as a duration (e.g. "30s"), or fallback if it is unset or invalid
+func EnvDuration(key string, fallback time.Duration) time.Duration {
+	v, err := time.ParseDuration(os.Getenv(key))
+	if err != nil {
+		return fallback
+	}
+	return v
+}
+
+// EnvList splits the comma separated environment variable key into its trimmed, non-empty values
+func EnvList(key string) []string {
+	var values []string
+	for _, v := range strings.Split(os.Getenv(key), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// EnvMap parses the comma separated environment variable key of the form "k1=v1,k2=v2" into a map
+func EnvMap(key string) map[string]string {
+	values := make(map[string]string)
+	for _, pair := range EnvList(key) {
+		k, v, ok := strings.Cut(pair, "=")
+		if !ok {
+			continue
+		}
+		values[strings.TrimSpace(k)] = strings.TrimSpace(v)
+	}
+	return values
+}